@@ -0,0 +1,113 @@
+package main
+
+/**
+ * File: aggregation.go
+ *
+ * While a service is buffering, the registry keeps track of every state it reported. When the
+ * init buffer expires, the state that is sent upstream depends on the buffer aggregation mode:
+ *
+ *   - latest:   the last state reported (the default)
+ *   - worst:    the most severe state reported (CRITICAL > UNKNOWN > WARNING > OK)
+ *   - majority: the state reported most often (ties go to the more severe state)
+ *
+ * When more than one result was collapsed into the one sent upstream, a summary of what was
+ * collapsed is appended to its output.
+ */
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	aggregationLatest   = "latest"
+	aggregationWorst    = "worst"
+	aggregationMajority = "majority"
+)
+
+// statesBySeverity lists the states from the most to the least severe
+var statesBySeverity = []uint16{stateCritical, stateUnknown, stateWarning, stateOk}
+
+// severity ranks states, higher is worse
+func severity(state uint16) int {
+	for i, s := range statesBySeverity {
+		if s == state {
+			return len(statesBySeverity) - i
+		}
+	}
+	return 0
+}
+
+func validAggregation(mode string) bool {
+	return mode == aggregationLatest || mode == aggregationWorst || mode == aggregationMajority
+}
+
+// bufferSummary holds the states seen while an entry is buffering
+type bufferSummary struct {
+	counts [stateUnknown + 1]int
+	last   [stateUnknown + 1]*Message
+	total  int
+}
+
+func (b *bufferSummary) reset() {
+	*b = bufferSummary{}
+}
+
+func (b *bufferSummary) add(m *Message) {
+	state := m.State
+	if state > stateUnknown {
+		state = stateUnknown
+	}
+	b.counts[state]++
+	b.last[state] = m
+	b.total++
+}
+
+// aggregate returns the message to send upstream for the buffer
+func (b *bufferSummary) aggregate(mode string, latest *Message) *Message {
+	var chosen uint16
+	switch mode {
+	case aggregationWorst:
+		for _, s := range statesBySeverity {
+			if b.counts[s] > 0 {
+				chosen = s
+				break
+			}
+		}
+	case aggregationMajority:
+		most := 0
+		for _, s := range statesBySeverity {
+			if b.counts[s] > most {
+				chosen, most = s, b.counts[s]
+			}
+		}
+	default:
+		return latest
+	}
+
+	if b.total <= 1 || b.last[chosen] == nil {
+		return latest
+	}
+	m := *b.last[chosen]
+	m.Message = addNote(m.Message, fmt.Sprintf("%s of %d results buffered: %s", mode, b.total, b))
+	return &m
+}
+
+// String summarizes the states seen, most severe first (e.g. "CRITICAL x2, OK x1")
+func (b *bufferSummary) String() string {
+	var parts []string
+	for _, s := range statesBySeverity {
+		if b.counts[s] > 0 {
+			parts = append(parts, fmt.Sprintf("%s x%d", stateName(s), b.counts[s]))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// bufferAggregationFor returns the buffer aggregation mode under the policy (nil for the defaults)
+func (c *NbadConfig) bufferAggregationFor(p *Policy) string {
+	if p != nil {
+		return p.BufferAggregation
+	}
+	return c.BufferAggregation
+}
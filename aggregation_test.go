@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBufferSummaryAggregate(t *testing.T) {
+	var b bufferSummary
+	latest := &Message{State: stateOk, Message: "fine"}
+	b.add(&Message{State: stateCritical, Message: "down"})
+	b.add(&Message{State: stateWarning, Message: "slow"})
+	b.add(&Message{State: stateWarning, Message: "slow"})
+	b.add(latest)
+
+	if m := b.aggregate(aggregationLatest, latest); m != latest {
+		t.Errorf("latest should return the latest message, got %v", m)
+	}
+	if m := b.aggregate(aggregationWorst, latest); m.State != stateCritical {
+		t.Errorf("worst should be CRITICAL, got %s", stateName(m.State))
+	}
+	if m := b.aggregate(aggregationMajority, latest); m.State != stateWarning {
+		t.Errorf("majority should be WARNING, got %s", stateName(m.State))
+	}
+	if s := b.String(); s != "CRITICAL x1, WARNING x2, OK x1" {
+		t.Errorf("Unexpected summary '%s'", s)
+	}
+}
+
+func TestBufferSummaryMajorityTieGoesToWorse(t *testing.T) {
+	var b bufferSummary
+	b.add(&Message{State: stateOk})
+	b.add(&Message{State: stateWarning})
+	if m := b.aggregate(aggregationMajority, nil); m.State != stateWarning {
+		t.Errorf("tie should go to WARNING, got %s", stateName(m.State))
+	}
+}
+
+func TestWorstAggregationReportsWorstThenCatchesUp(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		BufferAggregation: aggregationWorst})
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateCritical, Message: "down"})
+	after(g, clk, 2*time.Second)
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateOk, Message: "fine"})
+	after(g, clk, 10*time.Second)
+
+	if len(upstream.sent) != 1 || upstream.sent[0].Message.State != stateCritical {
+		t.Fatalf("Expected the worst state (CRITICAL) upstream, got %d notifications", len(upstream.sent))
+	}
+	output := upstream.sent[0].Message.Message
+	if !strings.HasPrefix(output, "down") || !strings.Contains(output, "CRITICAL x1, OK x1") {
+		t.Errorf("Expected output to summarize the collapsed results, got '%s'", output)
+	}
+
+	// the service keeps reporting OK, upstream has to be told eventually
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateOk, Message: "fine"})
+	after(g, clk, 10*time.Second)
+	if len(upstream.sent) != 2 || upstream.sent[1].Message.State != stateOk {
+		t.Fatalf("Expected OK to follow the CRITICAL, got %d notifications", len(upstream.sent))
+	}
+	if upstream.sent[1].Message.Message != "fine" {
+		t.Errorf("A single buffered result should be sent as is, got '%s'", upstream.sent[1].Message.Message)
+	}
+}
+
+func TestPolicyOverridesBufferAggregation(t *testing.T) {
+	useTestConfig(t, &NbadConfig{Policies: []*Policy{{Service: "disk*", BufferAggregation: aggregationWorst}}})
+	if m := Config().bufferAggregationFor(Config().policyFor("h", "disk_root", time.Now())); m != aggregationWorst {
+		t.Errorf("Expected policy aggregation, got '%s'", m)
+	}
+	if m := Config().bufferAggregationFor(Config().policyFor("h", "load", time.Now())); m != aggregationLatest {
+		t.Errorf("Expected default aggregation, got '%s'", m)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+/**
+ * File: api.go
+ *
+ * A small HTTP API for managing nbad at runtime. It is only started when api_address is set.
+ *
+ *   GET    /silences        list the current silences
+ *   POST   /silences        create a silence (JSON body, see Silence)
+ *   DELETE /silences/<id>   remove a silence (409 for silences from the config file)
+ */
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/JohnMurray/nbad/clock"
+)
+
+// newAPIHandler returns the handler serving the API
+func newAPIHandler(silences *SilenceStore, c clock.Clock) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/silences", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			writeJSON(w, http.StatusOK, silences.list())
+		case "POST":
+			silence := &Silence{}
+			if err := json.NewDecoder(r.Body).Decode(silence); err != nil {
+				http.Error(w, "invalid silence: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			silence.ID = ""
+			if err := silences.add(silence, c.Now()); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			Logger().Info.Printf("silence %s created by %s: %s\n", silence.ID, silence.Author, silence.Comment)
+			writeJSON(w, http.StatusCreated, silence)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/silences/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "DELETE" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimPrefix(r.URL.Path, "/silences/")
+		ok, err := silences.remove(id)
+		if err == errConfigSilence {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if !ok {
+			http.Error(w, "no silence with id '"+id+"'", http.StatusNotFound)
+			return
+		}
+		Logger().Info.Printf("silence %s removed\n", id)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// startAPI listens on the address and serves the API in the background
+func startAPI(address string, handler http.Handler) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	go http.Serve(listener, handler)
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JohnMurray/nbad/clock"
+)
+
+func TestSilenceAPI(t *testing.T) {
+	clk := clock.NewFake(time.Unix(1000, 0))
+	store, _ := openSilenceStore("", clk.Now())
+	server := httptest.NewServer(newAPIHandler(store, clk))
+	defer server.Close()
+
+	body := `{"host": "web*", "author": "jm", "comment": "deploy", "end": "2030-01-01T00:00:00Z"}`
+	resp, err := http.Post(server.URL+"/silences", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := &Silence{}
+	json.NewDecoder(resp.Body).Decode(created)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || created.ID == "" || !created.Start.Equal(clk.Now()) {
+		t.Fatalf("Expected the silence to be created, got %s %+v", resp.Status, created)
+	}
+
+	resp, err = http.Post(server.URL+"/silences", "application/json", strings.NewReader(`{"host": "web*"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an invalid silence to be rejected, got %s", resp.Status)
+	}
+
+	resp, err = http.Get(server.URL + "/silences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var silences []*Silence
+	json.NewDecoder(resp.Body).Decode(&silences)
+	resp.Body.Close()
+	if len(silences) != 1 || silences[0].ID != created.ID {
+		t.Fatalf("Expected to list the created silence, got %v", silences)
+	}
+
+	store.add(&Silence{ID: "config-1", Author: "a", End: clk.Now().Add(time.Hour), fromConfig: true}, clk.Now())
+	req, _ := http.NewRequest("DELETE", server.URL+"/silences/config-1", nil)
+	if resp, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusConflict {
+		t.Errorf("Expected removing a silence from the config to be refused, got %s", resp.Status)
+	}
+
+	for _, status := range []int{http.StatusNoContent, http.StatusNotFound} {
+		req, _ := http.NewRequest("DELETE", server.URL+"/silences/"+created.ID, nil)
+		resp, err = http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("Expected %d removing the silence, got %s", status, resp.Status)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+/**
+ * File: audit.go
+ *
+ * Every decision the gateway makes about a check result is written to the audit log, a
+ * JSON-lines file with one record per decision. It answers the "why didn't my page go out?"
+ * question without having to dig through the regular logs. The audit log is rotated the same
+ * way the capture file is (see rotate.go), which is also what limits how much is kept.
+ *
+ * 'nbad audit query' searches the audit log.
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// rules the gateway records decisions under
+const (
+	ruleBuffered           = "buffered"
+	ruleDiscardedDuplicate = "discarded-duplicate"
+	ruleFlap               = "flap"
+	ruleForwarded          = "forwarded"
+	ruleUnchanged          = "unchanged"
+	ruleRecoveryHeld       = "recovery-held"
+	ruleExpiry             = "expiry"
+	ruleFreshness          = "freshness"
+	ruleSilenceEnded       = "silence-ended"
+	ruleParentRecovered    = "parent-recovered"
+	ruleHostDown           = "host-down"
+	ruleHostUp             = "host-up"
+	ruleHostRecovered      = "host-recovered"
+	ruleStormDigest        = "storm-digest"
+	ruleStormSubsided      = "storm-subsided"
+	ruleRollup             = "rollup"
+	ruleDigest             = "digest"
+
+	upstreamSent   = "sent"
+	upstreamFailed = "failed"
+	upstreamNone   = "none"
+	upstreamHeld   = "held"
+	// upstreamSuppressed - not sent, a rollup stands in for the service (see rollup.go)
+	upstreamSuppressed = "suppressed"
+	// upstreamDigested - not sent, collected by a digest (see digest.go)
+	upstreamDigested = "digested"
+
+	defaultAuditMaxSizeInBytes = 50 * 1024 * 1024
+	defaultAuditMaxFiles       = 10
+)
+
+// AuditRecord is a single decision made by the gateway
+type AuditRecord struct {
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	Service string    `json:"service"`
+	Rule    string    `json:"rule"`
+	Reason  string    `json:"reason,omitempty"`
+	// OldState is what the upstream knew before the decision (empty if nothing)
+	OldState string `json:"old_state,omitempty"`
+	NewState string `json:"new_state"`
+	// OriginalState is what the client reported, if a policy remapped it
+	OriginalState string `json:"original_state,omitempty"`
+	Output        string `json:"output,omitempty"`
+	// CheckTimestamp is the timestamp the client put in the check result
+	CheckTimestamp time.Time `json:"check_timestamp"`
+	ReceivedAt     time.Time `json:"received_at"`
+	Upstream       string    `json:"upstream"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// AuditLog writes audit records to a rotating file
+type AuditLog struct {
+	*rotatingFile
+}
+
+// openAuditLog - opens (or creates) the audit log at path for appending
+func openAuditLog(path string, maxSize int64, maxFiles int) (*AuditLog, error) {
+	f, err := openRotatingFile(path, maxSize, maxFiles)
+	if err != nil {
+		return nil, fmt.Errorf("audit log: %v", err)
+	}
+	return &AuditLog{rotatingFile: f}, nil
+}
+
+func (a *AuditLog) record(r *AuditRecord) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return a.write(append(line, '\n'))
+}
+
+// newAuditRecord - describes a decision about message. n is the notification sent for it (nil if
+// none was) and err the result of sending it.
+func newAuditRecord(now time.Time, rule string, entry *MessageEntry, message *Message, n *Notification, err error) *AuditRecord {
+	r := &AuditRecord{
+		Time:           now,
+		Host:           entry.host,
+		Service:        entry.service,
+		Rule:           rule,
+		ReceivedAt:     entry.receivedAt,
+		Upstream:       upstreamNone,
+		CheckTimestamp: time.Unix(0, 0),
+	}
+	if entry.upstreamKnown {
+		r.OldState = stateName(entry.upstreamState)
+	}
+	if message != nil {
+		if message.Remapped {
+			r.OriginalState = stateName(message.OriginalState)
+		}
+		r.NewState = stateName(message.State)
+		r.Output = message.Message
+		r.CheckTimestamp = time.Unix(int64(message.Timestamp), 0)
+	}
+	if n != nil {
+		r.Reason = n.Reason
+		r.NewState = stateName(n.Message.State)
+		r.Output = n.Message.Message
+		r.Upstream = upstreamSent
+		if err != nil {
+			r.Upstream = upstreamFailed
+			r.Error = err.Error()
+		}
+	}
+	return r
+}
+
+// AuditQuery filters audit records, empty fields match everything
+type AuditQuery struct {
+	Host    string
+	Service string
+	Rule    string
+	Since   time.Time
+
+	hostRegex    *regexp.Regexp
+	serviceRegex *regexp.Regexp
+}
+
+func (q *AuditQuery) matches(r *AuditRecord) bool {
+	if !matchName(r.Host, q.hostRegex) || !matchName(r.Service, q.serviceRegex) {
+		return false
+	}
+	if q.Rule != "" && q.Rule != r.Rule {
+		return false
+	}
+	return !r.Time.Before(q.Since)
+}
+
+// queryAudit - calls fn for every record in the audit log matching the query
+func queryAudit(in io.Reader, q *AuditQuery, fn func(*AuditRecord)) error {
+	var err error
+	if q.hostRegex, err = compileMatcher("host", q.Host, ""); err != nil {
+		return err
+	}
+	if q.serviceRegex, err = compileMatcher("service", q.Service, ""); err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(in)
+	for {
+		r := &AuditRecord{}
+		if err := decoder.Decode(r); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if q.matches(r) {
+			fn(r)
+		}
+	}
+}
+
+// printAuditRecord - writes a readable form of the record
+func printAuditRecord(out io.Writer, r *AuditRecord) {
+	transition := r.NewState
+	if r.OldState != "" {
+		transition = r.OldState + " -> " + r.NewState
+	}
+	upstream := r.Upstream
+	if r.Error != "" {
+		upstream = upstream + ": " + r.Error
+	}
+	reason := ""
+	if r.Reason != "" {
+		reason = "  (" + r.Reason + ")"
+	}
+	fmt.Fprintf(out, "%s  %s/%s  %s  %s  upstream=%s%s  %q\n", r.Time.UTC().Format(time.RFC3339),
+		r.Host, r.Service, r.Rule, transition, upstream, reason, r.Output)
+}
+
+// parseSince - accepts either a duration (how far back) or an RFC3339 time
+func parseSince(since string, now time.Time) (time.Time, error) {
+	if since == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(since); err == nil {
+		return now.Add(-d), nil
+	}
+	t, err := time.Parse(time.RFC3339, since)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("--since must be a duration (e.g. 2h) or an RFC3339 time")
+	}
+	return t, nil
+}
+
+func auditCommand(configFile *string) cli.Command {
+	return cli.Command{
+		Name:  "audit",
+		Usage: "Work with the decision audit log",
+		Subcommands: []cli.Command{
+			{
+				Name:  "query",
+				Usage: "Print the decisions in the audit log matching the given filters",
+				Flags: []cli.Flag{
+					cli.StringFlag{Name: "host", Usage: "Only decisions for hosts matching this glob"},
+					cli.StringFlag{Name: "service", Usage: "Only decisions for services matching this glob"},
+					cli.StringFlag{Name: "rule", Usage: "Only decisions made by this rule"},
+					cli.StringFlag{Name: "since", Usage: "Only decisions since this long ago (e.g. 2h) or this RFC3339 time"},
+					cli.BoolFlag{Name: "json", Usage: "Print matching records as JSON lines"},
+				},
+				Action: func(c *cli.Context) {
+					logger := TempLogger("AUDIT")
+					InitConfig(*configFile, logger)
+					if Config().AuditFile == "" {
+						logger.Fatalln("no audit_file configured")
+					}
+					since, err := parseSince(c.String("since"), time.Now())
+					if err != nil {
+						logger.Fatalln(err)
+					}
+					q := &AuditQuery{Host: c.String("host"), Service: c.String("service"), Rule: c.String("rule"), Since: since}
+
+					encoder := json.NewEncoder(os.Stdout)
+					for _, file := range rotatedFiles(Config().AuditFile, int(Config().AuditMaxFiles)) {
+						f, err := os.Open(file)
+						if err != nil {
+							logger.Fatalf("could not open '%s': %v\n", file, err)
+						}
+						err = queryAudit(f, q, func(r *AuditRecord) {
+							if c.Bool("json") {
+								encoder.Encode(r)
+							} else {
+								printAuditRecord(os.Stdout, r)
+							}
+						})
+						f.Close()
+						if err != nil {
+							logger.Fatalf("could not read '%s': %v\n", file, err)
+						}
+					}
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGatewayDecisionsAreAudited(t *testing.T) {
+	g, _, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10})
+	dir, err := ioutil.TempDir("", "nbad-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	g.auditLog, err = openAuditLog(filepath.Join(dir, "audit.jsonl"), 1024*1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateCritical, Timestamp: 1000})
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateCritical, Timestamp: 1001})
+	after(g, clk, 10*time.Second)
+	after(g, clk, 60*time.Second)
+	g.auditLog.close()
+
+	f, _ := os.Open(g.auditLog.path)
+	defer f.Close()
+	var records []*AuditRecord
+	if err := queryAudit(f, &AuditQuery{}, func(r *AuditRecord) { records = append(records, r) }); err != nil {
+		t.Fatal(err)
+	}
+
+	rules := []string{ruleBuffered, ruleDiscardedDuplicate, ruleForwarded, ruleExpiry}
+	if len(records) != len(rules) {
+		t.Fatalf("Expected %d audit records, got %d", len(rules), len(records))
+	}
+	for i, rule := range rules {
+		if records[i].Rule != rule {
+			t.Errorf("Expected record %d to be %s, was %s", i, rule, records[i].Rule)
+		}
+	}
+	if records[2].Upstream != upstreamSent || records[2].OldState != "" || records[2].NewState != "CRITICAL" {
+		t.Errorf("Unexpected forwarded record %+v", records[2])
+	}
+	if records[3].OldState != "CRITICAL" || records[3].NewState != "OK" || records[3].Reason == "" {
+		t.Errorf("Unexpected expiry record %+v", records[3])
+	}
+}
+
+func TestAuditQueryFilters(t *testing.T) {
+	at := time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+	log := `{"time":"2016-06-01T11:00:00Z","host":"web1","service":"api","rule":"forwarded","new_state":"CRITICAL","upstream":"sent"}
+{"time":"2016-06-01T12:00:00Z","host":"web1","service":"api","rule":"buffered","new_state":"OK","upstream":"none"}
+{"time":"2016-06-01T12:00:00Z","host":"db1","service":"api","rule":"forwarded","new_state":"OK","upstream":"sent"}
+`
+	var out bytes.Buffer
+	q := &AuditQuery{Host: "web*", Rule: ruleForwarded, Since: at.Add(-2 * time.Hour)}
+	if err := queryAudit(strings.NewReader(log), q, func(r *AuditRecord) { printAuditRecord(&out, r) }); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "2016-06-01T11:00:00Z  web1/api  forwarded  CRITICAL  upstream=sent  \"\"\n"
+	if out.String() != expected {
+		t.Errorf("Unexpected query output:\n%s", out.String())
+	}
+}
+
+func TestParseSince(t *testing.T) {
+	now := time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+	if since, _ := parseSince("2h", now); !since.Equal(now.Add(-2 * time.Hour)) {
+		t.Errorf("Expected duration to be taken back from now, got %v", since)
+	}
+	if since, _ := parseSince("2016-06-01T08:00:00Z", now); since.Hour() != 8 {
+		t.Errorf("Expected RFC3339 time to be used as is, got %v", since)
+	}
+	if _, err := parseSince("yesterday", now); err == nil {
+		t.Errorf("Expected an error for an unparseable --since")
+	}
+}
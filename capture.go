@@ -0,0 +1,173 @@
+package main
+
+/**
+ * File: capture.go
+ *
+ * nbad can record the packets it receives from clients to a capture file. This is useful for
+ * debugging misbehaving clients and for feeding 'nbad simulate' with real traffic. Every record
+ * holds the time the packet was received, the client's address, the raw bytes and the result
+ * of parsing it. Records are written as JSON lines and the capture file is rotated once it
+ * reaches a configured size (see rotate.go).
+ *
+ * The policies' redact rules (see rewrite.go) apply before a packet is recorded. The raw bytes
+ * are left out of records whose output had something redacted, packets that could not be parsed
+ * are recorded as they were received.
+ *
+ * 'nbad capture dump' prints capture files in a readable form, or as input for 'nbad simulate'.
+ */
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+const (
+	defaultCaptureMaxSizeInBytes = 10 * 1024 * 1024
+	defaultCaptureMaxFiles       = 5
+)
+
+// CaptureRecord is a single packet received from a client
+type CaptureRecord struct {
+	ReceivedAt time.Time `json:"received_at"`
+	Client     string    `json:"client"`
+	Raw        []byte    `json:"raw"`
+	Accepted   bool      `json:"accepted"`
+	Error      string    `json:"error,omitempty"`
+	Message    *Message  `json:"message,omitempty"`
+}
+
+// Capture writes capture records to a rotating file. It is safe to use from multiple goroutines.
+type Capture struct {
+	*rotatingFile
+
+	// whether packets that could not be parsed are recorded too
+	rejected bool
+}
+
+// openCapture - opens (or creates) the capture file at path for appending
+func openCapture(path string, maxSize int64, maxFiles int, rejected bool) (*Capture, error) {
+	f, err := openRotatingFile(path, maxSize, maxFiles)
+	if err != nil {
+		return nil, fmt.Errorf("capture file: %v", err)
+	}
+	return &Capture{rotatingFile: f, rejected: rejected}, nil
+}
+
+// record writes the record to the capture file
+func (c *Capture) record(r *CaptureRecord) error {
+	if !r.Accepted && !c.rejected {
+		return nil
+	}
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return c.write(append(line, '\n'))
+}
+
+// readCapture - calls fn for every record in a capture file
+func readCapture(in io.Reader, fn func(*CaptureRecord) error) error {
+	scanner := bufio.NewScanner(in)
+	// records hold the raw packet (base64) so lines can be longer than the default limit
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		r := &CaptureRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), r); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		if err := fn(r); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// dumpRecord - writes a readable form of the record
+func dumpRecord(out io.Writer, r *CaptureRecord, raw bool) {
+	if r.Accepted {
+		fmt.Fprintf(out, "%s  %s  accepted  %s %s/%s %q\n", r.ReceivedAt.UTC().Format(time.RFC3339Nano),
+			r.Client, stateName(r.Message.State), r.Message.Host, r.Message.Service, r.Message.Message)
+	} else {
+		fmt.Fprintf(out, "%s  %s  rejected  %s (%d bytes)\n", r.ReceivedAt.UTC().Format(time.RFC3339Nano),
+			r.Client, r.Error, len(r.Raw))
+	}
+	if raw {
+		fmt.Fprint(out, hex.Dump(r.Raw))
+	}
+}
+
+// replayRecord - writes an accepted record as input for 'nbad simulate'
+func replayRecord(out io.Writer, r *CaptureRecord) error {
+	if !r.Accepted {
+		return nil
+	}
+	line, err := json.Marshal(&SimulatedResult{
+		Time:    r.ReceivedAt,
+		Host:    r.Message.Host,
+		Service: r.Message.Service,
+		State:   r.Message.State,
+		Output:  r.Message.Message,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(out, "%s\n", line)
+	return err
+}
+
+func captureCommand() cli.Command {
+	return cli.Command{
+		Name:  "capture",
+		Usage: "Work with traffic capture files",
+		Subcommands: []cli.Command{
+			{
+				Name:      "dump",
+				Usage:     "Print the records in capture files",
+				ArgsUsage: "capture-file [capture-file...]",
+				Flags: []cli.Flag{
+					cli.BoolFlag{
+						Name:  "raw",
+						Usage: "Include a hex dump of every packet",
+					},
+					cli.BoolFlag{
+						Name:  "replay",
+						Usage: "Print accepted records as input for 'nbad simulate'",
+					},
+				},
+				Action: func(c *cli.Context) {
+					logger := TempLogger("CAPTURE")
+					if len(c.Args()) == 0 {
+						logger.Fatalln("no capture files given")
+					}
+					for _, file := range c.Args() {
+						f, err := os.Open(file)
+						if err != nil {
+							logger.Fatalf("could not open '%s': %v\n", file, err)
+						}
+						err = readCapture(f, func(r *CaptureRecord) error {
+							if c.Bool("replay") {
+								return replayRecord(os.Stdout, r)
+							}
+							dumpRecord(os.Stdout, r, c.Bool("raw"))
+							return nil
+						})
+						f.Close()
+						if err != nil {
+							logger.Fatalf("could not read '%s': %v\n", file, err)
+						}
+					}
+				},
+			},
+		},
+	}
+}
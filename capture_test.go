@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCapture(t *testing.T, maxSize int64, rejected bool) (*Capture, string) {
+	dir, err := ioutil.TempDir("", "nbad-capture")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := openCapture(filepath.Join(dir, "capture.jsonl"), maxSize, 2, rejected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, dir
+}
+
+func TestCaptureRecordsAndReadsBack(t *testing.T) {
+	c, dir := newTestCapture(t, 1024*1024, true)
+	defer os.RemoveAll(dir)
+
+	at := time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+	c.record(&CaptureRecord{ReceivedAt: at, Client: "127.0.0.1:4000", Raw: []byte{0, 3}, Accepted: true,
+		Message: &Message{Host: "web1", Service: "api", State: stateCritical, Message: "down"}})
+	c.record(&CaptureRecord{ReceivedAt: at, Client: "127.0.0.1:4001", Raw: []byte{0, 2}, Error: "bad version"})
+	c.close()
+
+	f, _ := os.Open(c.path)
+	defer f.Close()
+	var out bytes.Buffer
+	err := readCapture(f, func(r *CaptureRecord) error {
+		dumpRecord(&out, r, false)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "2016-06-01T12:00:00Z  127.0.0.1:4000  accepted  CRITICAL web1/api \"down\"\n" +
+		"2016-06-01T12:00:00Z  127.0.0.1:4001  rejected  bad version (2 bytes)\n"
+	if out.String() != expected {
+		t.Errorf("Unexpected dump output:\n%s", out.String())
+	}
+}
+
+func TestCaptureSkipsRejectedUnlessEnabled(t *testing.T) {
+	c, dir := newTestCapture(t, 1024*1024, false)
+	defer os.RemoveAll(dir)
+
+	c.record(&CaptureRecord{ReceivedAt: time.Now(), Raw: []byte{0, 2}, Error: "bad version"})
+	c.close()
+
+	if contents, _ := ioutil.ReadFile(c.path); len(contents) != 0 {
+		t.Errorf("Expected rejected packets not to be recorded, got %s", contents)
+	}
+}
+
+func TestCaptureRotation(t *testing.T) {
+	c, dir := newTestCapture(t, 500, false)
+	defer os.RemoveAll(dir)
+
+	for i := 0; i < 10; i++ {
+		c.record(&CaptureRecord{ReceivedAt: time.Now(), Raw: make([]byte, 50), Accepted: true, Message: &Message{}})
+	}
+	c.close()
+
+	files, _ := filepath.Glob(filepath.Join(dir, "capture.jsonl*"))
+	if len(files) != 3 {
+		t.Errorf("Expected the capture file and 2 rotated files, found %v", files)
+	}
+	for _, file := range files {
+		if info, _ := os.Stat(file); info.Size() > 500 {
+			t.Errorf("Expected '%s' to have been rotated at 500 bytes, is %d", file, info.Size())
+		}
+	}
+}
+
+func TestReplayRecordFeedsSimulate(t *testing.T) {
+	var out bytes.Buffer
+	replayRecord(&out, &CaptureRecord{
+		ReceivedAt: time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC),
+		Accepted:   true,
+		Message:    &Message{Host: "web1", Service: "api", State: stateWarning, Message: "slow"},
+	})
+	replayRecord(&out, &CaptureRecord{Error: "bad version"})
+
+	expected := `{"time":"2016-06-01T12:00:00Z","host":"web1","service":"api","state":1,"output":"slow"}`
+	if strings.TrimSpace(out.String()) != expected {
+		t.Errorf("Unexpected replay output: %s", out.String())
+	}
+}
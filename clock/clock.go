@@ -0,0 +1,67 @@
+// Package clock provides a source of the current time that can be swapped out in tests
+/*
+
+Code that needs the current time should take a Clock rather than calling time.Now()
+directly. In production that is clock.Real, in tests a Fake can be used to control
+exactly when things happen without having to sleep:
+
+	c := clock.NewFake(time.Unix(0, 0))
+	f := flapper.NewFlapperWithClock(5, 30, c)
+	f.NoteStateChange("test")
+	c.Advance(31 * time.Second)
+
+A Fake is safe to be used from multiple goroutines.
+
+*/
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Real is the system clock
+var Real Clock = realClock{}
+
+// Fake is a clock that only moves when told to
+type Fake struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFake returns a fake clock set to now
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+// Now returns the fake clock's current time
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Advance moves the clock forward by d
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
+// Set moves the clock to t
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = t
+}
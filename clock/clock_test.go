@@ -0,0 +1,23 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeOnlyMovesWhenTold(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFake(start)
+
+	if !c.Now().Equal(start) {
+		t.Errorf("Expected fake clock to start at %v, got %v", start, c.Now())
+	}
+	c.Advance(90 * time.Second)
+	if !c.Now().Equal(start.Add(90 * time.Second)) {
+		t.Errorf("Expected fake clock to advance 90s, got %v", c.Now())
+	}
+	c.Set(start)
+	if !c.Now().Equal(start) {
+		t.Errorf("Expected fake clock to be set back to %v, got %v", start, c.Now())
+	}
+}
@@ -10,9 +10,14 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
 	"sync"
+	"text/template"
+
+	"github.com/JohnMurray/nbad/perfdata"
+	"github.com/JohnMurray/nbad/timeperiod"
 )
 
 // NbadConfig is just the struct that holds all of the config values
@@ -20,21 +25,149 @@ type NbadConfig struct {
 	// GatewayMessageBufferSize - The number of messages to buffer in memory for the gateway
 	GatewayMessageBufferSize uint `json:"gateway_message_buffer_size"`
 
+	// GatewayEnqueueTimeoutInMillis - How long to wait for room in a full gateway buffer before dropping a message
+	GatewayEnqueueTimeoutInMillis uint `json:"gateway_enqueue_timeout_in_millis"`
+
 	// MessageCacheTTLInSeconds - The time before a message expires (possibly causing reset of upstream state)
 	MessageCacheTTLInSeconds uint `json:"message_cache_ttl_in_seconds"`
 
 	// MessageInitBufferTimeSeconds - The amount of time a message is buffered before actioned upon
 	MessageInitBufferTimeSeconds uint `json:"message_init_buffer_ttl_in_seconds"`
 
+	// TombstoneTTLInSeconds - How long an expired service's last upstream state is remembered
+	TombstoneTTLInSeconds uint `json:"tombstone_ttl_in_seconds"`
+
+	// BufferAggregation - How results seen during the init buffer are aggregated (latest, worst or majority)
+	BufferAggregation string `json:"buffer_aggregation"`
+
+	// DedupNormalize - Volatile parts of the output masked before outputs are compared (timestamps, uuids, numbers)
+	DedupNormalize []string `json:"dedup_normalize"`
+
+	// ForwardOnOutputChange - Forward same-state results when their output changed, see dedup.go
+	ForwardOnOutputChange bool `json:"forward_on_output_change"`
+
+	// PerfdataParsing - How strictly perfdata is parsed: lenient (skips what it can't read) or strict (all or nothing)
+	PerfdataParsing string `json:"perfdata_parsing"`
+
+	// PerfdataChangePercent - Forward same-state results when a perfdata value moved by more than this (0 disables)
+	PerfdataChangePercent uint `json:"perfdata_change_percent"`
+
+	// RecoveryHoldInSeconds - How long an OK after a non-OK state must hold before it is sent upstream (0 disables)
+	RecoveryHoldInSeconds uint `json:"recovery_hold_in_seconds"`
+
 	// FlapCountThreshold - The max number of state-transitions a service can have that can happen within a time-window before considered 'flapping'
 	FlapCountThreshold uint `json:"flap_count_threshold"`
 
 	// TODO: add the flap timewindow back in (do we need it, or is init-buffer-time sufficient?)
 
+	// ExpiryAction - What to do when a service's state expires (ok, unknown, critical, sticky or none)
+	ExpiryAction string `json:"expiry_action"`
+
+	// ExpiryOutput - Template for the output of results synthesized on expiry
+	ExpiryOutput string `json:"expiry_output"`
+
+	// FreshnessThresholdInSeconds - How long any service may go without reporting before a CRITICAL is sent (0 disables)
+	FreshnessThresholdInSeconds uint `json:"freshness_threshold_in_seconds"`
+
+	// FreshnessManifestFile - File listing host/services that are expected to report and how often
+	FreshnessManifestFile string `json:"freshness_manifest_file"`
+
+	// CaptureFile - Record incoming packets to this file (disabled if empty), with the output redacted
+	// by the policies' redact rules. Rejected packets are recorded unredacted.
+	CaptureFile string `json:"capture_file"`
+
+	// CaptureRejected - Also record packets that could not be parsed
+	CaptureRejected bool `json:"capture_rejected"`
+
+	// CaptureMaxSizeInBytes - Size at which the capture file is rotated
+	CaptureMaxSizeInBytes uint `json:"capture_max_size_in_bytes"`
+
+	// CaptureMaxFiles - Number of rotated capture files to keep
+	CaptureMaxFiles uint `json:"capture_max_files"`
+
+	// AuditFile - Record every decision made by the gateway to this file (disabled if empty)
+	AuditFile string `json:"audit_file"`
+
+	// AuditMaxSizeInBytes - Size at which the audit log is rotated
+	AuditMaxSizeInBytes uint `json:"audit_max_size_in_bytes"`
+
+	// AuditMaxFiles - Number of rotated audit logs to keep
+	AuditMaxFiles uint `json:"audit_max_files"`
+
+	// SilencesFile - Where silences created at runtime are kept (not persisted if empty)
+	SilencesFile string `json:"silences_file"`
+
+	// Silences - Silences that are always loaded, see silence.go
+	Silences []*Silence `json:"silences"`
+
+	// APIAddress - Address the HTTP API listens on (disabled if empty)
+	APIAddress string `json:"api_address"`
+
+	// GraphiteAddress - Carbon plaintext endpoint states and perfdata are exported to, see graphite.go (disabled if empty)
+	GraphiteAddress string `json:"graphite_address"`
+
+	// GraphiteTemplate - Template of the paths metrics are exported under
+	GraphiteTemplate string `json:"graphite_template"`
+
+	// GraphiteBatchSize - Number of lines written to carbon at once
+	GraphiteBatchSize uint `json:"graphite_batch_size"`
+
+	// GraphiteFlushIntervalInMillis - How long lines wait for a batch to fill up
+	GraphiteFlushIntervalInMillis uint `json:"graphite_flush_interval_in_millis"`
+
+	// GraphiteMaxPending - Number of lines kept while carbon can't be reached
+	GraphiteMaxPending uint `json:"graphite_max_pending"`
+
+	// TimePeriods - Named time periods policies and silences can refer to, see the timeperiod package
+	TimePeriods map[string]*timeperiod.Definition `json:"timeperiods"`
+
+	// HostLivenessServices - Services telling whether their host is up ("" for host checks), see host.go
+	HostLivenessServices []string `json:"host_liveness_services"`
+
+	// Storms - Storm detectors holding alerts while many services fail at once, see storm.go
+	Storms []*Storm `json:"storms"`
+
+	// Rollups - Services computed from the services of many hosts, see rollup.go
+	Rollups []*Rollup `json:"rollups"`
+
+	// Digests - Summaries policies can send results to instead of upstream, see digest.go
+	Digests []*Digest `json:"digests"`
+
+	// Dependencies - Services whose alerts are held while the service they depend on fails
+	Dependencies []*Dependency `json:"dependencies"`
+
+	// Policies - Ordered list of per-service overrides (first match wins)
+	Policies []*Policy `json:"policies"`
+
 	// TraceLogging - Enable trace logging (for debugging purposes) (not in JSON config file)
 	TraceLogging bool
+
+	// expiry - the default expiry policy (compiled from ExpiryAction and ExpiryOutput)
+	expiry *ExpiryPolicy
+
+	// graphitePath - compiled from GraphiteTemplate
+	graphitePath *template.Template
+
+	// perfdataMode - compiled from PerfdataParsing
+	perfdataMode perfdata.Mode
+
+	// dedup - the default dedup policy (compiled from DedupNormalize and the forwarding options)
+	dedup *DedupPolicy
+
+	// timePeriods - compiled from TimePeriods
+	timePeriods map[string]*timeperiod.Period
+
+	// digests - Digests by name
+	digests map[string]*Digest
 }
 
+const defaultTombstoneTTLInSeconds = 3600
+
+const (
+	perfdataLenient = "lenient"
+	perfdataStrict  = "strict"
+)
+
 var configLoadOnce sync.Once
 var nbadConfig *NbadConfig
 
@@ -77,4 +210,106 @@ func validateConfig(logger *log.Logger) {
 	if c.MessageInitBufferTimeSeconds > c.MessageCacheTTLInSeconds {
 		logger.Fatalln("init buffer ttl cannot be greater than message cache ttl")
 	}
+
+	if err := c.compile(); err != nil {
+		logger.Fatalf("invalid config: %v\n", err)
+	}
+}
+
+// compile - fills in defaults and prepares the policies for use
+func (c *NbadConfig) compile() error {
+	if c.TombstoneTTLInSeconds == 0 {
+		c.TombstoneTTLInSeconds = defaultTombstoneTTLInSeconds
+	}
+	if c.CaptureMaxSizeInBytes == 0 {
+		c.CaptureMaxSizeInBytes = defaultCaptureMaxSizeInBytes
+	}
+	if c.CaptureMaxFiles == 0 {
+		c.CaptureMaxFiles = defaultCaptureMaxFiles
+	}
+	if c.AuditMaxSizeInBytes == 0 {
+		c.AuditMaxSizeInBytes = defaultAuditMaxSizeInBytes
+	}
+	if c.AuditMaxFiles == 0 {
+		c.AuditMaxFiles = defaultAuditMaxFiles
+	}
+
+	if c.GraphiteBatchSize == 0 {
+		c.GraphiteBatchSize = defaultGraphiteBatchSize
+	}
+	if c.GraphiteFlushIntervalInMillis == 0 {
+		c.GraphiteFlushIntervalInMillis = defaultGraphiteFlushIntervalMillis
+	}
+	if c.GraphiteMaxPending == 0 {
+		c.GraphiteMaxPending = defaultGraphiteMaxPending
+	}
+
+	if c.BufferAggregation == "" {
+		c.BufferAggregation = aggregationLatest
+	}
+	if !validAggregation(c.BufferAggregation) {
+		return fmt.Errorf("unknown buffer aggregation '%s'", c.BufferAggregation)
+	}
+
+	expiry, err := newExpiryPolicy(c.ExpiryAction, c.ExpiryOutput)
+	if err != nil {
+		return err
+	}
+	c.expiry = expiry
+
+	if c.graphitePath, err = newGraphiteTemplate(c.GraphiteTemplate); err != nil {
+		return err
+	}
+
+	switch c.PerfdataParsing {
+	case "", perfdataLenient:
+		c.perfdataMode = perfdata.Lenient
+	case perfdataStrict:
+		c.perfdataMode = perfdata.Strict
+	default:
+		return fmt.Errorf("unknown perfdata parsing mode '%s'", c.PerfdataParsing)
+	}
+
+	if c.dedup, err = newDedupPolicy(c.DedupNormalize, c.ForwardOnOutputChange, c.PerfdataChangePercent); err != nil {
+		return err
+	}
+
+	if c.timePeriods, err = timeperiod.Compile(c.TimePeriods); err != nil {
+		return err
+	}
+
+	if err := c.compileDependencies(); err != nil {
+		return err
+	}
+
+	if err := c.compileStorms(); err != nil {
+		return err
+	}
+
+	if err := c.compileRollups(); err != nil {
+		return err
+	}
+
+	if err := c.compileDigests(); err != nil {
+		return err
+	}
+
+	for _, p := range c.Policies {
+		if err := p.compile(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// nameSet - the names taken by the storms, rollups or digests of the config
+type nameSet map[string]bool
+
+// add takes name for what is defined, an error if it was already taken
+func (n nameSet) add(name string, defined fmt.Stringer) error {
+	if n[name] {
+		return fmt.Errorf("%s: defined more than once", defined)
+	}
+	n[name] = true
+	return nil
 }
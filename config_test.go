@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// useTestConfig installs c as the global config for the duration of a test
+func useTestConfig(t *testing.T, c *NbadConfig) *NbadConfig {
+	if err := c.compile(); err != nil {
+		t.Fatalf("invalid test config: %v", err)
+	}
+	nbadConfig = c
+	return c
+}
+
+func TestCompileRejectsBadPolicies(t *testing.T) {
+	c := &NbadConfig{Policies: []*Policy{{Service: "[", ExpiryAction: "ok"}}}
+	if err := c.compile(); err == nil {
+		t.Errorf("Expected an invalid service pattern to be rejected")
+	}
+}
+
+func TestCompileRejectsNamesDefinedTwice(t *testing.T) {
+	configs := []*NbadConfig{
+		{Storms: []*Storm{{Name: "s", Threshold: 5, WindowInSeconds: 60}, {Name: "s", Threshold: 5, WindowInSeconds: 60}}},
+		{Rollups: []*Rollup{{Name: "r", Service: "api", CriticalPercent: 50}, {Name: "r", Service: "db", CriticalPercent: 50}}},
+		{Digests: []*Digest{{Name: "d", IntervalInSeconds: 60}, {Name: "d", IntervalInSeconds: 60}}},
+	}
+	for _, c := range configs {
+		if err := c.compile(); err == nil || !strings.Contains(err.Error(), "defined more than once") {
+			t.Errorf("Expected a name defined twice to be rejected, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+/**
+ * File: dedup.go
+ *
+ * A result in the same state as what upstream already has is a duplicate, whatever its output
+ * says. That is usually what we want, but "DISK CRITICAL 91%" and "DISK CRITICAL 99%" are not
+ * quite the same thing. Same-state results can be forwarded anyway when:
+ *
+ *   - forward_on_output_change: the text of the output (without perfdata) changed
+ *   - perfdata_change_percent:  a perfdata value moved by more than that percentage
+ *
+ * compared to the last result sent upstream. Volatile parts of the output (timestamps, UUIDs,
+ * numbers) can be masked before the text is compared with dedup_normalize, so that only the
+ * changes that matter count. Nothing changes while the service is buffering, the result sent
+ * when the buffer ends is the latest anyway.
+ */
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+)
+
+// mask replaces a volatile part of the output before outputs are compared
+type mask struct {
+	name        string
+	re          *regexp.Regexp
+	replacement string
+}
+
+// masks, in the order they are applied (numbers go last, they are part of the others)
+var masks = []*mask{
+	{"timestamps", regexp.MustCompile(`\d{4}-\d{2}-\d{2}[T ]\d{2}:\d{2}(:\d{2}(\.\d+)?)?(Z|[+-]\d{2}:?\d{2})?|\b\d{1,2}:\d{2}(:\d{2})?\b|\b1\d{9}\b`), "<time>"},
+	{"uuids", regexp.MustCompile(`(?i)\b[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}\b`), "<uuid>"},
+	{"numbers", regexp.MustCompile(`-?\d+(\.\d+)?`), "<n>"},
+}
+
+// DedupPolicy decides which same-state results are worth sending upstream
+type DedupPolicy struct {
+	masks                 []*mask
+	onOutputChange        bool
+	perfdataChangePercent uint
+}
+
+func newDedupPolicy(normalize []string, onOutputChange bool, perfdataChangePercent uint) (*DedupPolicy, error) {
+	enabled := make(map[string]bool, len(normalize))
+	for _, name := range normalize {
+		enabled[name] = true
+	}
+	d := &DedupPolicy{onOutputChange: onOutputChange, perfdataChangePercent: perfdataChangePercent}
+	for _, m := range masks {
+		if enabled[m.name] {
+			d.masks = append(d.masks, m)
+			delete(enabled, m.name)
+		}
+	}
+	for name := range enabled {
+		return nil, fmt.Errorf("unknown dedup normalization '%s'", name)
+	}
+	return d, nil
+}
+
+// normalize masks the volatile parts of the text
+func (d *DedupPolicy) normalize(text string) string {
+	for _, m := range d.masks {
+		text = m.re.ReplaceAllString(text, m.replacement)
+	}
+	return text
+}
+
+// significantChange returns why the message is worth sending although upstream already has its
+// state, "" if it is a duplicate of the last result sent
+func (d *DedupPolicy) significantChange(last *Message, m *Message) string {
+	if last == nil {
+		return ""
+	}
+	before, after := last.parsed(), m.parsed()
+	if d.onOutputChange &&
+		d.normalize(after.Text+"\n"+after.LongText) != d.normalize(before.Text+"\n"+before.LongText) {
+		return "output changed"
+	}
+	if d.perfdataChangePercent == 0 {
+		return ""
+	}
+
+	values := make(map[string]float64)
+	for _, v := range before.Perfdata {
+		if !v.Unknown {
+			values[v.Label] = v.Value
+		}
+	}
+	for _, v := range after.Perfdata {
+		was, ok := values[v.Label]
+		if !ok || v.Unknown || was == v.Value {
+			continue
+		}
+		if was == 0 || math.Abs(v.Value-was)/math.Abs(was)*100 > float64(d.perfdataChangePercent) {
+			return fmt.Sprintf("perfdata '%s' changed from %g%s to %g%s", v.Label, was, v.UOM, v.Value, v.UOM)
+		}
+	}
+	return ""
+}
+
+// dedupFor returns the dedup policy under the policy (nil for the defaults)
+func (c *NbadConfig) dedupFor(p *Policy) *DedupPolicy {
+	if p != nil {
+		return p.dedup
+	}
+	return c.dedup
+}
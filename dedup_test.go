@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignificantChange(t *testing.T) {
+	var tests = []struct {
+		normalize      []string
+		onOutputChange bool
+		percent        uint
+		last           string
+		output         string
+		changed        bool
+	}{
+		{nil, false, 0, "DISK CRITICAL 91%", "DISK CRITICAL 99%", false},
+		{nil, true, 0, "DISK CRITICAL 91%", "DISK CRITICAL 99%", true},
+		{nil, true, 0, "DISK CRITICAL 91% | /=91%", "DISK CRITICAL 91% | /=92%", false},
+		{[]string{"numbers"}, true, 0, "DISK CRITICAL 91%", "DISK CRITICAL 99%", false},
+		{[]string{"timestamps"}, true, 0, "stuck since 2016-06-01T12:00:00Z", "stuck since 2016-06-01T12:05:00Z", false},
+		{[]string{"timestamps"}, true, 0, "stuck since 12:00", "stuck since 12:05, job 4", true},
+		{[]string{"uuids"}, true, 0, "job 0d8ff3ce-6c0c-4dd2-8ef2-1bc7c2d1a5e4 failed", "job 7f9a0f1c-52ab-4b5e-a8a4-13f2a7c9a0b2 failed", false},
+		{[]string{"numbers"}, true, 5, "DISK CRITICAL | /=91%", "DISK CRITICAL | /=93%", false},
+		{[]string{"numbers"}, true, 5, "DISK CRITICAL | /=91%", "DISK CRITICAL | /=99%", true},
+		{nil, false, 5, "queue | depth=0", "queue | depth=3", true},
+	}
+	for i, tt := range tests {
+		d, err := newDedupPolicy(tt.normalize, tt.onOutputChange, tt.percent)
+		if err != nil {
+			t.Fatalf("failed test %d: %v", i, err)
+		}
+		why := d.significantChange(&Message{Message: tt.last}, &Message{Message: tt.output})
+		if (why != "") != tt.changed {
+			t.Errorf("failed test %d: changed=%v (%s), wanted %v", i, why != "", why, tt.changed)
+		}
+	}
+
+	if _, err := newDedupPolicy([]string{"dates"}, true, 0); err == nil {
+		t.Errorf("Expected an unknown normalization to be rejected")
+	}
+}
+
+func TestSameStateForwardedWhenPerfdataMoves(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		DedupNormalize: []string{"numbers"}, ForwardOnOutputChange: true, PerfdataChangePercent: 5})
+	report := func(output string) {
+		g.handleMessage(&Message{Host: "h", Service: "disk", State: stateCritical, Message: output})
+	}
+	report("DISK CRITICAL - 91% used | /=91%")
+	after(g, clk, 10*time.Second)
+	report("DISK CRITICAL - 92% used | /=92%")
+	report("DISK CRITICAL - 99% used | /=99%")
+	report("DISK CRITICAL - 99% used | /=99%")
+
+	if len(upstream.sent) != 2 {
+		t.Fatalf("Expected the first result and the jump to 99%% to be sent, got %d notifications", len(upstream.sent))
+	}
+	if n := upstream.sent[1]; n.Message.Message != "DISK CRITICAL - 99% used | /=99%" ||
+		n.Reason != "perfdata '/' changed from 91% to 99%" {
+		t.Errorf("Unexpected notification %s (%s)", n.Message.Message, n.Reason)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+/**
+ * File: dependency.go
+ *
+ * Dependencies keep a failing service (the parent, e.g. a database) from paging once for every
+ * service that fails along with it (the children, e.g. the apps using the database). While the
+ * parent is not OK, what the gateway would send for a child is either held (see hold.go) until
+ * the parent recovers, or sent with a note about the parent ("annotate"). Recoveries of the
+ * child are never held.
+ *
+ * The parent's state is whatever the registry currently has for it, whether or not that has
+ * been sent upstream yet. A parent nbad knows nothing about (or has forgotten) is assumed OK.
+ */
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	dependencyHold     = "hold"
+	dependencyAnnotate = "annotate"
+)
+
+// Dependency makes the services matching Host and Service (globs) depend on a parent service
+type Dependency struct {
+	// Host - glob pattern matched against the host name of the children (empty matches all)
+	Host string `json:"host"`
+
+	// Service - glob pattern matched against the service name of the children (empty matches all)
+	Service string `json:"service"`
+
+	// ParentHost - host of the parent service
+	ParentHost string `json:"parent_host"`
+
+	// ParentService - the parent service
+	ParentService string `json:"parent_service"`
+
+	// Action - what to do with child alerts while the parent is not OK: hold (default) or annotate
+	Action string `json:"action"`
+
+	hostRegex    *regexp.Regexp
+	serviceRegex *regexp.Regexp
+}
+
+// String describes the dependency, for log and error messages
+func (d *Dependency) String() string {
+	return fmt.Sprintf("dependency of '%s/%s' on %s/%s", d.Host, d.Service, d.ParentHost, d.ParentService)
+}
+
+// matches returns true if the host and service are children of the dependency. The parent is
+// never its own child.
+func (d *Dependency) matches(host string, service string) bool {
+	if host == d.ParentHost && service == d.ParentService {
+		return false
+	}
+	return matchName(host, d.hostRegex) && matchName(service, d.serviceRegex)
+}
+
+func (d *Dependency) compile() error {
+	var err error
+	if d.hostRegex, err = compileMatcher("host", d.Host, ""); err != nil {
+		return fmt.Errorf("%s: %v", d, err)
+	}
+	if d.serviceRegex, err = compileMatcher("service", d.Service, ""); err != nil {
+		return fmt.Errorf("%s: %v", d, err)
+	}
+	if d.ParentHost == "" || d.ParentService == "" {
+		return fmt.Errorf("%s: needs a parent_host and a parent_service", d)
+	}
+	if d.Action == "" {
+		d.Action = dependencyHold
+	}
+	if d.Action != dependencyHold && d.Action != dependencyAnnotate {
+		return fmt.Errorf("%s: unknown action '%s'", d, d.Action)
+	}
+	return nil
+}
+
+// compileDependencies validates the dependencies and makes sure parents don't (indirectly)
+// depend on each other, which would hold their alerts until one of them recovers by itself
+func (c *NbadConfig) compileDependencies() error {
+	for _, d := range c.Dependencies {
+		if err := d.compile(); err != nil {
+			return err
+		}
+	}
+
+	// walk up from every parent, it must never come back to itself
+	for _, d := range c.Dependencies {
+		start := registryKey(d.ParentHost, d.ParentService)
+		seen := map[string]bool{}
+		next := []*Dependency{d}
+		for len(next) > 0 {
+			parent := next[0]
+			next = next[1:]
+			for _, up := range c.dependenciesFor(parent.ParentHost, parent.ParentService) {
+				key := registryKey(up.ParentHost, up.ParentService)
+				if key == start {
+					return fmt.Errorf("%s: the dependencies form a cycle", d)
+				}
+				if !seen[key] {
+					seen[key] = true
+					next = append(next, up)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// dependenciesFor returns the dependencies the host and service are a child of
+func (c *NbadConfig) dependenciesFor(host string, service string) []*Dependency {
+	var deps []*Dependency
+	for _, d := range c.Dependencies {
+		if d.matches(host, service) {
+			deps = append(deps, d)
+		}
+	}
+	return deps
+}
+
+// failingParent returns the first dependency of the entry whose parent is not OK, along with
+// the parent's current state
+func (g *Gateway) failingParent(entry *MessageEntry) (*Dependency, uint16) {
+	for _, d := range entry.dependencies {
+		parent := g.registry.getEntry(registryKey(d.ParentHost, d.ParentService))
+		if parent == nil || parent.message == nil || parent.phase == phaseTombstoned {
+			continue
+		}
+		if parent.message.State != stateOk {
+			return d, parent.message.State
+		}
+	}
+	return nil, stateOk
+}
+
+// annotateDependency notes on the notification that the parent of the dependency is failing
+func annotateDependency(n *Notification, d *Dependency, parentState uint16) {
+	m := *n.Message
+	m.Message = addNote(m.Message, fmt.Sprintf("depends on %s/%s, which is %s",
+		d.ParentHost, d.ParentService, stateName(parentState)))
+	n.Message = &m
+}
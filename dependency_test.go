@@ -0,0 +1,99 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JohnMurray/nbad/clock"
+)
+
+func TestDependencyCompileErrors(t *testing.T) {
+	tests := [][]*Dependency{
+		{{Host: "app*", ParentService: "mysql"}},
+		{{Host: "[", ParentHost: "db1", ParentService: "mysql"}},
+		{{Host: "app*", ParentHost: "db1", ParentService: "mysql", Action: "ignore"}},
+		{
+			{Host: "db1", Service: "mysql", ParentHost: "nfs", ParentService: "mount"},
+			{Host: "nfs", Service: "mount", ParentHost: "db1", ParentService: "mysql"},
+		},
+	}
+	for i, deps := range tests {
+		c := &NbadConfig{Dependencies: deps}
+		if err := c.compile(); err == nil {
+			t.Errorf("Expected dependencies %d to be rejected", i)
+		}
+	}
+
+	c := &NbadConfig{Dependencies: []*Dependency{{ParentHost: "db1", ParentService: "mysql"}}}
+	if err := c.compile(); err != nil {
+		t.Errorf("A dependency of everything on one service is fine, got %v", err)
+	}
+	if len(c.dependenciesFor("db1", "mysql")) != 0 {
+		t.Errorf("The parent should not depend on itself")
+	}
+}
+
+// newDependencyTest returns a gateway where the app services depend on db1/mysql, which is
+// CRITICAL upstream
+func newDependencyTest(t *testing.T, action string) (*Gateway, *recordingUpstream, *clock.Fake) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		Dependencies: []*Dependency{{Host: "app*", ParentHost: "db1", ParentService: "mysql", Action: action}}})
+	g.handleMessage(&Message{Host: "db1", Service: "mysql", State: stateCritical})
+	after(g, clk, 10*time.Second)
+	return g, upstream, clk
+}
+
+func TestChildAlertsHeldWhileParentFails(t *testing.T) {
+	g, upstream, clk := newDependencyTest(t, dependencyHold)
+	for _, host := range []string{"app1", "app2", "app3"} {
+		g.handleMessage(&Message{Host: host, Service: "http", State: stateCritical})
+	}
+	after(g, clk, 10*time.Second)
+	if len(upstream.sent) != 1 {
+		t.Fatalf("Only the parent should have been sent, got %d notifications", len(upstream.sent))
+	}
+
+	// app3 recovers on its own before the database does
+	g.handleMessage(&Message{Host: "app3", Service: "http", State: stateOk})
+	g.handleMessage(&Message{Host: "db1", Service: "mysql", State: stateOk})
+	after(g, clk, 10*time.Second)
+
+	var children []string
+	for _, n := range upstream.sent[1:] {
+		if n.Message.Host != "db1" && n.Message.State == stateCritical {
+			children = append(children, n.Message.Host)
+			if !strings.HasPrefix(n.Reason, "parent recovered") {
+				t.Errorf("Unexpected reason '%s'", n.Reason)
+			}
+		}
+	}
+	if len(children) != 2 || strings.Contains(strings.Join(children, ","), "app3") {
+		t.Errorf("Expected the apps still failing to be released, got %v", children)
+	}
+}
+
+func TestChildRecoveryIsNotHeld(t *testing.T) {
+	g, upstream, clk := newDependencyTest(t, dependencyHold)
+	// app1 was already CRITICAL upstream before the database failed
+	g.registry.noteUpstream(g.registry.update(&Message{Host: "app1", Service: "http", State: stateCritical}), stateCritical)
+	after(g, clk, 10*time.Second)
+	g.handleMessage(&Message{Host: "app1", Service: "http", State: stateOk})
+	after(g, clk, 10*time.Second)
+	if last := upstream.sent[len(upstream.sent)-1]; last.Message.Host != "app1" || last.Message.State != stateOk {
+		t.Errorf("Expected the recovery of app1 to be sent, last sent was %s for %s",
+			stateName(last.Message.State), last.Message.Host)
+	}
+}
+
+func TestChildAlertsAnnotatedWhileParentFails(t *testing.T) {
+	g, upstream, clk := newDependencyTest(t, dependencyAnnotate)
+	g.handleMessage(&Message{Host: "app1", Service: "http", State: stateCritical, Message: "timeout"})
+	after(g, clk, 10*time.Second)
+	if len(upstream.sent) != 2 {
+		t.Fatalf("Expected the child to be sent, got %d notifications", len(upstream.sent))
+	}
+	if output := upstream.sent[1].Message.Message; output != "timeout [nbad: depends on db1/mysql, which is CRITICAL]" {
+		t.Errorf("Unexpected output '%s'", output)
+	}
+}
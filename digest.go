@@ -0,0 +1,244 @@
+package main
+
+/**
+ * File: digest.go
+ *
+ * Low-priority noise (WARNINGs, mostly) is better read once in a while than paged for one
+ * service at a time. Policies can send the results of their services to a digest instead of
+ * upstream. The digest counts the results of every service it collects within its interval
+ * (a sliding window) and, at the end of every interval, sends a single result to its own
+ * digest service listing those counts and the current state of each service. The summary is
+ * as bad as the worst state still collected.
+ *
+ * Only results in the digest's states (WARNING by default) are collected, and only while
+ * upstream has nothing worse for the service. A service that was collected keeps being
+ * collected until it recovers, anything else (e.g. it goes CRITICAL) is sent as usual.
+ */
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JohnMurray/nbad/timewindow"
+)
+
+const defaultDigestIntervalInSeconds = 15 * 60
+
+// Digest collects results into a summary sent at a fixed interval
+type Digest struct {
+	// Name - identifies the digest for policies, and in logs and the default digest service
+	Name string `json:"name"`
+
+	// IntervalInSeconds - how often the summary is sent (default 900)
+	IntervalInSeconds uint `json:"interval_in_seconds"`
+
+	// States - names of the states collected (default WARNING only)
+	States []string `json:"states"`
+
+	// DigestHost - host the summary is sent for (default "nbad")
+	DigestHost string `json:"digest_host"`
+
+	// DigestService - service the summary is sent as (default "digest <name>")
+	DigestService string `json:"digest_service"`
+
+	states map[uint16]bool
+}
+
+// String describes the digest, for log and error messages
+func (d *Digest) String() string {
+	return fmt.Sprintf("digest '%s'", d.Name)
+}
+
+func (d *Digest) compile() error {
+	if d.Name == "" {
+		return fmt.Errorf("digest needs a name")
+	}
+	if d.IntervalInSeconds == 0 {
+		d.IntervalInSeconds = defaultDigestIntervalInSeconds
+	}
+	if len(d.States) == 0 {
+		d.States = []string{stateName(stateWarning)}
+	}
+	d.states = make(map[uint16]bool, len(d.States))
+	for _, name := range d.States {
+		state, ok := stateByName(name)
+		if !ok || state == stateOk {
+			return fmt.Errorf("%s: can't collect state '%s'", d, name)
+		}
+		d.states[state] = true
+	}
+	if d.DigestHost == "" {
+		d.DigestHost = nbadHost
+	}
+	if d.DigestService == "" {
+		d.DigestService = "digest " + d.Name
+	}
+	return nil
+}
+
+// stateByName returns the state for its name (as returned by 'stateName'), ignoring case
+func stateByName(name string) (uint16, bool) {
+	for _, state := range statesBySeverity {
+		if strings.EqualFold(name, stateName(state)) {
+			return state, true
+		}
+	}
+	return 0, false
+}
+
+// compileDigests validates the digests and indexes them by name for the policies
+func (c *NbadConfig) compileDigests() error {
+	c.digests = make(map[string]*Digest, len(c.Digests))
+	names := nameSet{}
+	for _, d := range c.Digests {
+		if err := d.compile(); err != nil {
+			return err
+		}
+		if err := names.add(d.Name, d); err != nil {
+			return err
+		}
+		c.digests[d.Name] = d
+	}
+	return nil
+}
+
+// digestFor returns the digest under the policy (nil for the defaults), nil if there is none
+func (c *NbadConfig) digestFor(p *Policy) *Digest {
+	if p != nil {
+		return p.digest
+	}
+	return nil
+}
+
+// digestState is what the gateway tracks for a digest
+type digestState struct {
+	*Digest
+
+	// services collected in the current window, keyed by registryKey
+	services map[string]*digestedService
+	// when the next summary is due
+	nextAt time.Time
+}
+
+// digestedService is a service collected by a digest
+type digestedService struct {
+	// window - results collected, by second
+	window *timewindow.Window
+	// state - the last state collected
+	state uint16
+}
+
+func newDigestStates(digests []*Digest, now time.Time) map[string]*digestState {
+	states := make(map[string]*digestState, len(digests))
+	for _, d := range digests {
+		states[d.Name] = &digestState{
+			Digest:   d,
+			services: make(map[string]*digestedService),
+			nextAt:   now.Add(time.Duration(d.IntervalInSeconds) * time.Second),
+		}
+	}
+	return states
+}
+
+// digestFor returns the digest collecting the notification for the entry, nil if it is to be
+// sent as usual
+func (g *Gateway) digestFor(entry *MessageEntry, n *Notification, now time.Time) *digestState {
+	d := Config().digestFor(entry.policyAt(now))
+	if d == nil || (entry.host == d.DigestHost && entry.service == d.DigestService) {
+		return nil
+	}
+	state := n.Message.State
+	if d.states[state] && (entry.digested || !entry.upstreamKnown || entry.upstreamState == stateOk) {
+		return g.digests[d.Name]
+	}
+	if state == stateOk && entry.digested {
+		return g.digests[d.Name]
+	}
+	return nil
+}
+
+// collect - counts the notification towards the next summary
+func (d *digestState) collect(entry *MessageEntry, n *Notification, now time.Time) {
+	key := registryKey(entry.host, entry.service)
+	s, ok := d.services[key]
+	if !ok {
+		s = &digestedService{window: timewindow.New(now.Unix(), int(d.IntervalInSeconds))}
+		d.services[key] = s
+	}
+	s.window = advanceWindow(s.window, d.IntervalInSeconds, now)
+	s.window.Add(now.Unix(), 1)
+	s.state = n.Message.State
+}
+
+// updateDigests - sends the summaries that are due
+func (g *Gateway) updateDigests() {
+	now := g.clock.Now()
+	for _, d := range g.digests {
+		if now.Before(d.nextAt) {
+			continue
+		}
+		for !d.nextAt.After(now) {
+			d.nextAt = d.nextAt.Add(time.Duration(d.IntervalInSeconds) * time.Second)
+		}
+
+		var state uint16 = stateOk
+		results, lines := 0, []string{}
+		keys := make([]string, 0, len(d.services))
+		current := make(map[string]uint16, len(d.services))
+		for key, s := range d.services {
+			s.window = advanceWindow(s.window, d.IntervalInSeconds, now)
+			// the service may have been sent as usual since (e.g. it went CRITICAL)
+			entry := g.registry.getEntry(key)
+			collected := entry != nil && entry.digested
+			if s.window.Total() == 0 && (!collected || s.state == stateOk) {
+				// nothing left to say about it
+				delete(d.services, key)
+				continue
+			}
+			keys = append(keys, key)
+			current[key] = s.state
+			if !collected && entry != nil && entry.message != nil {
+				current[key] = entry.message.State
+			}
+			if collected && severity(s.state) > severity(state) {
+				state = s.state
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			total := d.services[key].window.Total()
+			results += total
+			if len(lines) < maxListedServices {
+				lines = append(lines, fmt.Sprintf("%s %s x%d", key, stateName(current[key]), total))
+			}
+		}
+		if len(keys) > maxListedServices {
+			lines = append(lines, fmt.Sprintf("and %d more", len(keys)-maxListedServices))
+		}
+
+		// the entry for the summary is only created once there is something to send
+		var sent uint16
+		var known bool
+		if entry := g.registry.getEntry(registryKey(d.DigestHost, d.DigestService)); entry != nil {
+			sent, known = entry.pendingState()
+		}
+		if results == 0 && (sent == state || !known) {
+			// nothing new since the last summary
+			continue
+		}
+		output := fmt.Sprintf("%d results for %d services in the last %v", results, len(keys),
+			time.Duration(d.IntervalInSeconds)*time.Second)
+		if len(lines) > 0 {
+			output += ": " + strings.Join(lines, ", ")
+		}
+		Logger().Info.Printf("%s: %s\n", d, output)
+		from := &Message{Host: d.DigestHost, Service: d.DigestService}
+		g.decision(ruleDigest, g.registry.own(d.DigestHost, d.DigestService), nil, &Notification{
+			Message:     newSynthesizedMessage(from, state, output, uint32(now.Unix())),
+			Reason:      "digest interval",
+			Synthesized: true,
+		})
+	}
+}
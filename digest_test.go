@@ -0,0 +1,90 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigestCollectsWarnings(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		Digests:  []*Digest{{Name: "warnings", IntervalInSeconds: 60}},
+		Policies: []*Policy{{Service: "disk*", Digest: "warnings"}}})
+	report := func(service string, state uint16) {
+		g.handleMessage(&Message{Host: "h", Service: service, State: state})
+	}
+	report("disk1", stateOk)
+	report("disk2", stateOk)
+	after(g, clk, 10*time.Second)
+	upstream.sent = nil
+
+	report("disk1", stateWarning)
+	report("disk2", stateWarning)
+	after(g, clk, 10*time.Second)
+	report("disk1", stateOk)
+	report("disk2", stateCritical)
+	after(g, clk, 10*time.Second)
+
+	if len(upstream.sent) != 1 || upstream.sent[0].Message.Service != "disk2" ||
+		upstream.sent[0].Message.State != stateCritical {
+		t.Fatalf("Expected only disk2 going CRITICAL to be sent, got %d notifications", len(upstream.sent))
+	}
+	if entry := g.registry.getEntry(registryKey("h", "disk2")); entry.digested {
+		t.Errorf("disk2 was sent as usual, it should no longer be collected")
+	}
+
+	after(g, clk, 30*time.Second)
+	if len(upstream.sent) != 2 {
+		t.Fatalf("Expected the digest to be sent after its interval")
+	}
+	digest := upstream.sent[1].Message
+	if digest.Host != "nbad" || digest.Service != "digest warnings" || digest.State != stateOk {
+		t.Errorf("Expected an OK digest (nothing is still collected), got %s for %s/%s",
+			stateName(digest.State), digest.Host, digest.Service)
+	}
+	if !strings.Contains(digest.Message, "h/disk1 OK x2, h/disk2 CRITICAL x1") {
+		t.Errorf("Expected counts and current states per service, got %s", digest.Message)
+	}
+
+	// nothing new, nothing sent (the services expire meanwhile, which is not collected)
+	upstream.sent = nil
+	after(g, clk, 60*time.Second)
+	for _, n := range upstream.sent {
+		if n.Message.Service == "digest warnings" {
+			t.Errorf("Expected no digest without anything new to say, got %s", n.Message.Message)
+		}
+	}
+}
+
+func TestDigestRejectsUnknownStates(t *testing.T) {
+	c := &NbadConfig{Digests: []*Digest{{Name: "warnings", States: []string{"WARN"}}}}
+	if err := c.compile(); err == nil {
+		t.Errorf("Expected an unknown state to be rejected")
+	}
+}
+
+func TestDigestEntryIsOnlyCreatedWhenSent(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		Digests:  []*Digest{{Name: "warnings", IntervalInSeconds: 60}},
+		Policies: []*Policy{{Service: "disk*", Digest: "warnings"}}})
+	key := registryKey("nbad", "digest warnings")
+	after(g, clk, 2*time.Minute)
+	if g.registry.getEntry(key) != nil || len(upstream.sent) != 0 {
+		t.Fatalf("Expected nothing to be sent or kept for a digest with nothing to say")
+	}
+
+	g.handleMessage(&Message{Host: "h", Service: "disk1", State: stateWarning})
+	after(g, clk, time.Minute)
+	if len(upstream.sent) != 1 || g.registry.getEntry(key) == nil {
+		t.Fatalf("Expected the digest to be sent, got %d notifications", len(upstream.sent))
+	}
+
+	// what upstream was told about the digest outlives the tombstone ttl
+	after(g, clk, 2*time.Hour)
+	if entry := g.registry.getEntry(key); entry == nil || !entry.upstreamKnown {
+		t.Errorf("Expected the digest entry to be kept")
+	}
+	if _, _, ok := g.registry.timers.Next(); ok {
+		t.Errorf("Expected nothing left to do once everything has expired")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+/**
+ * File: expiry.go
+ *
+ * When a service has not reported in a while its last known state expires. What happens then
+ * is up to the service's expiry policy. The available actions are:
+ *
+ *   - ok:       WARNING and CRITICAL states are cleared by sending OK upstream (the default)
+ *   - unknown:  the service is set to UNKNOWN ("no data")
+ *   - critical: the service is set to CRITICAL
+ *   - sticky:   nothing is sent, the last state is kept until the service reports again
+ *   - none:     nothing is sent and the state is forgotten
+ *
+ * The output of the synthesized result is a text/template, see expiryTemplateData for the
+ * values that are available to it.
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+const (
+	expiryActionOk       = "ok"
+	expiryActionUnknown  = "unknown"
+	expiryActionCritical = "critical"
+	expiryActionSticky   = "sticky"
+	expiryActionNone     = "none"
+
+	defaultExpiryOutput = "no check result received in {{.Age}}, last state was {{.LastState}}"
+)
+
+// ExpiryPolicy decides what (if anything) is sent upstream when a service's state expires
+type ExpiryPolicy struct {
+	Action string
+	output *template.Template
+}
+
+// expiryTemplateData holds the values available to the expiry output template
+type expiryTemplateData struct {
+	Host       string
+	Service    string
+	LastState  string
+	NewState   string
+	LastOutput string
+	LastSeen   time.Time
+	Age        time.Duration
+}
+
+// newExpiryPolicy - validates the action and compiles the output template. An empty action
+// or output falls back to the defaults.
+func newExpiryPolicy(action string, output string) (*ExpiryPolicy, error) {
+	if action == "" {
+		action = expiryActionOk
+	}
+	switch action {
+	case expiryActionOk, expiryActionUnknown, expiryActionCritical, expiryActionSticky, expiryActionNone:
+	default:
+		return nil, fmt.Errorf("unknown expiry action '%s'", action)
+	}
+
+	if output == "" {
+		output = defaultExpiryOutput
+	}
+	tmpl, err := template.New("expiry").Parse(output)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse expiry output template: %v", err)
+	}
+
+	return &ExpiryPolicy{Action: action, output: tmpl}, nil
+}
+
+// expiredState returns the state to send upstream for a service that expired in state 'last'.
+// The second return value is false when nothing should be sent.
+func (p *ExpiryPolicy) expiredState(last uint16) (uint16, bool) {
+	switch p.Action {
+	case expiryActionOk:
+		if last == stateWarning || last == stateCritical {
+			return stateOk, true
+		}
+	case expiryActionUnknown:
+		if last != stateUnknown {
+			return stateUnknown, true
+		}
+	case expiryActionCritical:
+		if last != stateCritical {
+			return stateCritical, true
+		}
+	}
+	return 0, false
+}
+
+// notification builds the synthesized result for an expired message, or nil if the policy
+// does not send anything for it
+func (p *ExpiryPolicy) notification(last *Message, lastSeen time.Time, now time.Time) (*Notification, error) {
+	state, send := p.expiredState(last.State)
+	if !send {
+		return nil, nil
+	}
+
+	data := &expiryTemplateData{
+		Host:       last.Host,
+		Service:    last.Service,
+		LastState:  stateName(last.State),
+		NewState:   stateName(state),
+		LastOutput: last.Message,
+		LastSeen:   lastSeen,
+		Age:        now.Sub(lastSeen) / time.Second * time.Second,
+	}
+	var output bytes.Buffer
+	if err := p.output.Execute(&output, data); err != nil {
+		return nil, fmt.Errorf("could not render expiry output for service '%s': %v", last.Service, err)
+	}
+
+	return &Notification{
+		Message:     newSynthesizedMessage(last, state, output.String(), uint32(now.Unix())),
+		Reason:      fmt.Sprintf("state expired, expiry action '%s'", p.Action),
+		Synthesized: true,
+	}, nil
+}
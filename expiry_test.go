@@ -0,0 +1,70 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExpiredStateForActions(t *testing.T) {
+	var tests = []struct {
+		action string
+		last   uint16
+		state  uint16
+		send   bool
+	}{
+		{expiryActionOk, stateOk, 0, false},
+		{expiryActionOk, stateWarning, stateOk, true},
+		{expiryActionOk, stateCritical, stateOk, true},
+		{expiryActionOk, stateUnknown, 0, false},
+		{expiryActionUnknown, stateCritical, stateUnknown, true},
+		{expiryActionUnknown, stateUnknown, 0, false},
+		{expiryActionCritical, stateOk, stateCritical, true},
+		{expiryActionCritical, stateCritical, 0, false},
+		{expiryActionSticky, stateCritical, 0, false},
+		{expiryActionNone, stateWarning, 0, false},
+	}
+
+	for i, tt := range tests {
+		p, err := newExpiryPolicy(tt.action, "")
+		if err != nil {
+			t.Fatalf("failed test %d: %v", i, err)
+		}
+		state, send := p.expiredState(tt.last)
+		if send != tt.send || state != tt.state {
+			t.Errorf("failed test %d: action %s from %s gave (%s, %v) wanted (%s, %v)", i, tt.action,
+				stateName(tt.last), stateName(state), send, stateName(tt.state), tt.send)
+		}
+	}
+}
+
+func TestUnknownExpiryActionIsRejected(t *testing.T) {
+	if _, err := newExpiryPolicy("explode", ""); err == nil {
+		t.Errorf("Expected an error for an unknown expiry action")
+	}
+}
+
+func TestExpiryNotificationOutputIsTemplatedAndMarked(t *testing.T) {
+	p, err := newExpiryPolicy(expiryActionUnknown, "{{.Service}} silent for {{.Age}} (was {{.LastState}})")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	last := &Message{State: stateCritical, Host: "host", Service: "backup", Message: "failed"}
+	now := time.Now()
+	n, err := p.notification(last, now.Add(-90*time.Second), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n.Message.State != stateUnknown || !n.Synthesized {
+		t.Errorf("Expected synthesized UNKNOWN, got %s (synthesized=%v)", stateName(n.Message.State), n.Synthesized)
+	}
+	expected := synthesizedPrefix + "backup silent for 1m30s (was CRITICAL)"
+	if n.Message.Message != expected {
+		t.Errorf("Expected output '%s', got '%s'", expected, n.Message.Message)
+	}
+	if !strings.Contains(n.Reason, expiryActionUnknown) {
+		t.Errorf("Expected reason to mention the expiry action, got '%s'", n.Reason)
+	}
+}
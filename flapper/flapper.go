@@ -2,8 +2,7 @@
 package flapper
 
 import (
-	"time"
-
+	"github.com/JohnMurray/nbad/clock"
 	"github.com/JohnMurray/nbad/timewindow"
 )
 
@@ -17,14 +16,23 @@ type Flapper struct {
 
 	// a map of servie-names to sliding window-counters
 	services map[string]*timewindow.Window
+
+	// source of the epochs fed to the time-windows
+	clock clock.Clock
 }
 
 // NewFlapper - Create a new instance of Flapper
 func NewFlapper(max uint, duration uint) *Flapper {
+	return NewFlapperWithClock(max, duration, clock.Real)
+}
+
+// NewFlapperWithClock - Create a new instance of Flapper that tells time with the given clock
+func NewFlapperWithClock(max uint, duration uint, c clock.Clock) *Flapper {
 	f := &Flapper{
 		max:      max,
 		duration: duration,
 		services: make(map[string]*timewindow.Window),
+		clock:    c,
 	}
 	return f
 }
@@ -33,11 +41,12 @@ func NewFlapper(max uint, duration uint) *Flapper {
 // Increment the counter for a service (or create a counter for the service if one has not
 // alredy been created). (Lazily create services).
 func (f *Flapper) NoteStateChange(service string) {
+	now := f.clock.Now().Unix()
 	if state, ok := f.services[service]; ok {
-		state.Add(time.Now().Unix(), 1)
+		state.Add(now, 1)
 	} else {
-		f.services[service] = timewindow.New(time.Now().Unix(), int(f.duration))
-		f.services[service].Add(time.Now().Unix(), 1)
+		f.services[service] = timewindow.New(now, int(f.duration))
+		f.services[service].Add(now, 1)
 	}
 }
 
@@ -50,7 +59,7 @@ func (f *Flapper) NoteStateChange(service string) {
 func (f *Flapper) IsFlapping(service string, recompute bool) bool {
 	if state, ok := f.services[service]; ok {
 		if recompute {
-			state.Add(time.Now().Unix(), 0)
+			state.Add(f.clock.Now().Unix(), 0)
 		}
 		return state.Total() >= int(f.max)
 	}
@@ -3,6 +3,8 @@ package flapper
 import (
 	"testing"
 	"time"
+
+	"github.com/JohnMurray/nbad/clock"
 )
 
 func TestAddStateChange(t *testing.T) {
@@ -37,11 +39,12 @@ func TestSimpleFlapDetection(t *testing.T) {
 }
 
 func TestSpacedFlapDetection(t *testing.T) {
-	flapper := NewFlapper(10, 10)
+	c := clock.NewFake(time.Unix(1000, 0))
+	flapper := NewFlapperWithClock(10, 10, c)
 
 	for i := uint(0); i < flapper.max; i++ {
 		flapper.NoteStateChange("test")
-		time.Sleep(500 * time.Millisecond)
+		c.Advance(500 * time.Millisecond)
 	}
 
 	if !flapper.IsFlapping("test", true) {
@@ -50,11 +53,12 @@ func TestSpacedFlapDetection(t *testing.T) {
 }
 
 func TestFlapDetectionResetsOnSlidingOneSecondWindows(t *testing.T) {
-	flapper := NewFlapper(10, 2)
+	c := clock.NewFake(time.Unix(1000, 0))
+	flapper := NewFlapperWithClock(10, 2, c)
 
 	for i := uint(0); i < flapper.max; i++ {
 		if i == (flapper.max / uint(2)) {
-			time.Sleep(1 * time.Second)
+			c.Advance(1 * time.Second)
 		}
 		flapper.NoteStateChange("test")
 	}
@@ -63,7 +67,7 @@ func TestFlapDetectionResetsOnSlidingOneSecondWindows(t *testing.T) {
 		t.Errorf("Should be flapping when 'max' state changes reported in less than 'duration'")
 	}
 
-	time.Sleep(1200 * time.Millisecond)
+	c.Advance(1200 * time.Millisecond)
 
 	if flapper.IsFlapping("test", true) {
 		t.Errorf("Should not be flapping when window has moved past counts")
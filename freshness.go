@@ -0,0 +1,82 @@
+package main
+
+/**
+ * File: freshness.go
+ *
+ * Some services (cron jobs, heartbeats, etc) are expected to report on a regular interval and
+ * silence means something is wrong. These services can be given an expected reporting interval
+ * (freshness threshold) and when one goes longer than that without reporting, a CRITICAL is sent
+ * upstream on its behalf.
+ *
+ * Thresholds come either from the config (globally or per-policy) or from a manifest file. The
+ * manifest lists host/service pairs explicitly so that services that have never reported (since
+ * nbad started) are covered as well. The manifest is a JSON list of:
+ *
+ *    { "host": "db1", "service": "nightly-backup", "interval_in_seconds": 90000 }
+ */
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// FreshnessExpectation is a single service listed in the freshness manifest
+type FreshnessExpectation struct {
+	Host              string `json:"host"`
+	Service           string `json:"service"`
+	IntervalInSeconds uint   `json:"interval_in_seconds"`
+}
+
+// FreshnessExpiry is an event raised when a service has not reported within its expected interval
+type FreshnessExpiry struct{ key string }
+
+// loadFreshnessManifest - reads the list of expected services from a manifest file
+func loadFreshnessManifest(file string) ([]*FreshnessExpectation, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("could not open freshness manifest '%s': %v", file, err)
+	}
+	defer f.Close()
+
+	var expectations []*FreshnessExpectation
+	if err := json.NewDecoder(f).Decode(&expectations); err != nil {
+		return nil, fmt.Errorf("could not read freshness manifest '%s': %v", file, err)
+	}
+
+	for i, e := range expectations {
+		if e.Host == "" || e.Service == "" || e.IntervalInSeconds == 0 {
+			return nil, fmt.Errorf("freshness manifest '%s': entry %d needs a host, service and interval", file, i)
+		}
+	}
+	return expectations, nil
+}
+
+// freshnessIntervalFor returns how often services under the policy (nil for the defaults) are
+// expected to report, 0 if they are not watched
+func (c *NbadConfig) freshnessIntervalFor(p *Policy) time.Duration {
+	threshold := c.FreshnessThresholdInSeconds
+	if p != nil && p.FreshnessThresholdInSeconds != nil {
+		threshold = *p.FreshnessThresholdInSeconds
+	}
+	return time.Duration(threshold) * time.Second
+}
+
+// staleNotification builds the CRITICAL sent upstream for a service that missed its interval
+func staleNotification(entry *MessageEntry, now time.Time) *Notification {
+	output := fmt.Sprintf("no check result in %v (expected every %v)",
+		now.Sub(entry.receivedAt)/time.Second*time.Second, entry.freshnessInterval/time.Second*time.Second)
+
+	from := entry.message
+	if from == nil {
+		from = &Message{Host: entry.host, Service: entry.service}
+		output = output + ", service has not reported since nbad started"
+	}
+
+	return &Notification{
+		Message:     newSynthesizedMessage(from, stateCritical, output, uint32(now.Unix())),
+		Reason:      "missed expected reporting interval",
+		Synthesized: true,
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JohnMurray/nbad/clock"
+)
+
+func TestLoadFreshnessManifest(t *testing.T) {
+	f, err := ioutil.TempFile("", "nbad-manifest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`[{"host": "db1", "service": "backup", "interval_in_seconds": 600}]`)
+	f.Close()
+
+	expectations, err := loadFreshnessManifest(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(expectations) != 1 || expectations[0].Service != "backup" || expectations[0].IntervalInSeconds != 600 {
+		t.Errorf("Unexpected manifest contents %v", expectations)
+	}
+}
+
+func TestExpectationSurvivesUpdates(t *testing.T) {
+	useTestConfig(t, &NbadConfig{MessageCacheTTLInSeconds: 60})
+	clk := clock.NewFake(time.Unix(1000, 0))
+	r := newRegistry(60, 0, 3600, clk)
+
+	r.expect("db1", "backup", 10*time.Minute)
+	r.update(&Message{Host: "db1", Service: "backup", State: stateOk})
+
+	entry := r.getEntry(registryKey("db1", "backup"))
+	if entry.freshnessInterval != 10*time.Minute {
+		t.Errorf("Expected manifest interval to be kept, got %s", entry.freshnessInterval)
+	}
+	if !entry.freshnessDeadline.Equal(clk.Now().Add(10 * time.Minute)) {
+		t.Errorf("Expected freshness deadline to move forward on update")
+	}
+}
+
+func TestStaleNotificationForNeverReportedService(t *testing.T) {
+	now := time.Now()
+	entry := &MessageEntry{
+		host:              "db1",
+		service:           "backup",
+		receivedAt:        now.Add(-15 * time.Minute),
+		freshnessInterval: 10 * time.Minute,
+	}
+
+	n := staleNotification(entry, now)
+	if n.Message.State != stateCritical || n.Message.Host != "db1" || n.Message.Service != "backup" {
+		t.Errorf("Expected CRITICAL for db1/backup, got %v", n.Message)
+	}
+	if !strings.Contains(n.Message.Message, "no check result in 15m0s (expected every 10m0s)") {
+		t.Errorf("Unexpected output '%s'", n.Message.Message)
+	}
+}
+
+func TestStaleNotificationForShortIntervals(t *testing.T) {
+	now := time.Unix(1000, 0)
+	entry := &MessageEntry{host: "h", service: "s", message: &Message{Host: "h", Service: "s"},
+		receivedAt: now.Add(-90*time.Second - 400*time.Millisecond), freshnessInterval: 30 * time.Second}
+	if n := staleNotification(entry, now); !strings.Contains(n.Message.Message, "no check result in 1m30s (expected every 30s)") {
+		t.Errorf("Unexpected output '%s'", n.Message.Message)
+	}
+}
+
+func TestExpiryDoesNotClearStaleServices(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		FreshnessThresholdInSeconds: 20})
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateCritical})
+	after(g, clk, 10*time.Second)
+
+	// the service goes silent, goes stale after 20s and expires after the ttl (60s), the expiry
+	// would set it back to OK
+	after(g, clk, 2*time.Minute)
+	if len(upstream.sent) != 2 || !upstream.sent[1].Synthesized || upstream.sent[1].Message.State != stateCritical {
+		t.Fatalf("Expected only the stale CRITICAL after the CRITICAL, got %d notifications", len(upstream.sent))
+	}
+}
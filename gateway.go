@@ -10,23 +10,56 @@ package main
  *  - NSCA message received from client
  *  - StateExpiry event received from registry
  *  - InitBufferExpiry event received from registry
+ *  - FreshnessExpiry event received from registry
+ *
+ * Whatever the gateway decides to send for a silenced service, one whose parent is failing, or
+ * one caught in an alert storm, is held rather than sent until that is no longer the case
+ * (see hold.go).
  *
  * The first event comes direclty from the client and by us listening to a socket. This results
- * in a message being stored in the registry. The other two messages are both expiry events.
+ * in a message being stored in the registry. The other messages are all expiry events.
  * These events are raised by calling 'Gateway.expireOldMessages' and is called via the 'tick'
  * that runs as part of the gateway's listener code (see 'handleIncomingEvents').
+ *
+ * Only client messages go through the gateway's channel. Expiry events are raised and handled
+ * on the gateway's own goroutine, which is also the only one draining the channel, so they must
+ * never be sent through it. When the channel is full, client messages are dropped after waiting
+ * up to the configured enqueue timeout (see 'enqueue').
  */
 
 import (
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/JohnMurray/nbad/clock"
 )
 
 // Gateway is where all the messages flow through
 type Gateway struct {
+	// number of client messages dropped because the channel was full (accessed atomically)
+	dropped uint64
+	// number of dropped messages already logged
+	droppedReported uint64
+
 	registry          *Registry
 	incomingEventChan chan *GatewayEvent
+	upstream          Upstream
+	auditLog          *AuditLog
+	silences          *SilenceStore
+	enqueueTimeout    time.Duration
+	clock             clock.Clock
 	startOnce         sync.Once
+
+	// entries with a notification held back (keyed by registryKey), see hold.go
+	held map[string]*MessageEntry
+	// storm detectors, see storm.go
+	storms []*stormState
+	// digests by name, see digest.go
+	digests map[string]*digestState
+	// when the rollups are next computed, see rollup.go
+	rollupsAt time.Time
 }
 
 // GatewayEvent represents union of events a Gateway expects to receive
@@ -34,13 +67,14 @@ type GatewayEvent struct {
 	message          *Message
 	stateExpiry      *StateExpiry
 	initBufferExpiry *InitBufferExpiry
+	freshnessExpiry  *FreshnessExpiry
 }
 
 // StateExpiry is an event raised when the current service state expires (no recent message)
-type StateExpiry struct{ service string }
+type StateExpiry struct{ key string }
 
 // InitBufferExpiry is an event raised when buffering of initial server state has been reached
-type InitBufferExpiry struct{ service string }
+type InitBufferExpiry struct{ key string }
 
 /**
  * Initiates the gateway that listens and processes various types of events.
@@ -51,117 +85,403 @@ func (g *Gateway) run() {
 	})
 }
 
-// handleIncomingEvents - listen for incoming events and dispatch them to the appropriate handling code
+// maxWakeInterval - the longest the gateway sleeps when no registry deadline is coming up
+const maxWakeInterval = time.Second
+
+// handleIncomingEvents - listen for incoming events and dispatch them to the appropriate handling code.
+// Rather than ticking on a fixed interval, the gateway sleeps until the next deadline in the registry.
 func (g *Gateway) handleIncomingEvents() {
-	tick := time.Tick(100 * time.Millisecond)
+	wakeAt := g.nextWakeup()
+	timer := time.NewTimer(wakeAt.Sub(g.clock.Now()))
 	for {
 		select {
-		case <-tick:
-			g.expireOldMessages()
+		case <-timer.C:
+			g.tick()
+			wakeAt = g.nextWakeup()
+			timer.Reset(wakeAt.Sub(g.clock.Now()))
 		case event := <-g.incomingEventChan:
 			if event == nil {
 				continue
 			}
 			g.handleMessageStateChange(event)
+			// the message may have brought the next deadline forward
+			if next := g.nextWakeup(); next.Before(wakeAt) {
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				wakeAt = next
+				timer.Reset(wakeAt.Sub(g.clock.Now()))
+			}
+		}
+	}
+}
+
+// tick - the housekeeping done whenever the gateway wakes up. The simulation wakes the gateway
+// up the same way (see simulate.go).
+func (g *Gateway) tick() {
+	g.expireOldMessages()
+	g.updateRollups()
+	g.updateDigests()
+	g.releaseHeld()
+	g.reportDropped()
+}
+
+// nextWakeup - when the gateway next needs to check the registry for expired entries
+func (g *Gateway) nextWakeup() time.Time {
+	wakeAt := g.clock.Now().Add(maxWakeInterval)
+	if _, at, ok := g.registry.timers.Next(); ok && at.Before(wakeAt) {
+		return at
+	}
+	return wakeAt
+}
+
+// enqueue hands a client message to the gateway. If the gateway is not keeping up and its
+// channel is full, waits up to the enqueue timeout before dropping the message. Returns false
+// if the message was dropped.
+func (g *Gateway) enqueue(m *Message) bool {
+	event := newMessageEvent(m)
+	select {
+	case g.incomingEventChan <- event:
+		return true
+	default:
+	}
+
+	if g.enqueueTimeout > 0 {
+		timer := time.NewTimer(g.enqueueTimeout)
+		defer timer.Stop()
+		select {
+		case g.incomingEventChan <- event:
+			return true
+		case <-timer.C:
 		}
 	}
+
+	atomic.AddUint64(&g.dropped, 1)
+	return false
 }
 
-// expireOldMessages - scan registry and emit events for message expirations
+// reportDropped - log how many messages were dropped since the last report (if any)
+func (g *Gateway) reportDropped() {
+	dropped := atomic.LoadUint64(&g.dropped)
+	if dropped != g.droppedReported {
+		Logger().Warning.Printf("gateway buffer full, dropped %d messages (%d total)\n",
+			dropped-g.droppedReported, dropped)
+		g.droppedReported = dropped
+	}
+}
+
+// expireOldMessages - handle the registry entries whose deadlines have passed
 func (g *Gateway) expireOldMessages() {
-	now := time.Now()
-	for _, v := range g.registry.cache {
-		if now.After(v.expireAt) {
-			// send notification of message expiration
-			g.incomingEventChan <- &GatewayEvent{stateExpiry: &StateExpiry{service: v.message.Service}}
-		} else if now.After(v.initBufferExpireAt) {
-			// send notification of init-buffer expiry
-			g.incomingEventChan <- &GatewayEvent{initBufferExpiry: &InitBufferExpiry{service: v.message.Service}}
+	now := g.clock.Now()
+	removed := 0
+	for _, k := range g.registry.timers.PopDue(now) {
+		v := g.registry.getEntry(k)
+		if v == nil {
+			continue
+		}
+
+		// handled here rather than sent through the channel, this goroutine is the one draining it
+		if v.freshnessInterval > 0 && !v.freshnessAlerted && !now.Before(v.freshnessDeadline) {
+			// only raised once, the flag is cleared when the service reports again
+			v.freshnessAlerted = true
+			g.handleMessageStateChange(&GatewayEvent{freshnessExpiry: &FreshnessExpiry{key: k}})
+		}
+		switch v.phase {
+		case phaseBuffering:
+			if !now.Before(v.initBufferExpireAt) {
+				// init-buffer expiry
+				g.handleMessageStateChange(&GatewayEvent{initBufferExpiry: &InitBufferExpiry{key: k}})
+			}
+		case phaseDecided:
+			if !now.Before(v.expireAt) {
+				// message expiration
+				g.handleMessageStateChange(&GatewayEvent{stateExpiry: &StateExpiry{key: k}})
+			}
+		case phaseTombstoned:
+			if g.registry.collect(v, now) {
+				removed++
+				continue
+			}
 		}
+
+		// whatever happened, the entry needs to wait on its next deadline
+		g.registry.schedule(v)
+	}
+
+	if removed > 0 {
+		Logger().Trace.Printf("removed %d tombstones from the registry\n", removed)
 	}
 }
 
 func (g *Gateway) handleMessageStateChange(event *GatewayEvent) {
 	if event.message != nil {
-		/*
-		 * The event is an incoming message. All incoming messages should be buffered for a small
-		 * period of time to make sure we're not thrashing (flip-flopping). However we have to be careful
-		 * so that a flooding scenario doesn't cause us to stall indefinitely. Thus the following rules
-		 * can be applied:
-		 *   - if no previous service alert, store
-		 *   - if previous service alert with same state (OK, WARN, etc), discard current message, don't update TTLs
-		 *   - if previous service alert is different:
-		 *     - update flap counter, raise alert if service is flapping
-		 *     - store message, update TTLs
-		 */
-		if message := g.registry.get(event.message.Service); message != nil {
-			if message.State == event.message.State {
-				// same state, discard
-			} else {
-				// different state
-				if f := g.registry.getFlap(event.message.Service); f != nil {
-					f.NoteStateChange(event.message.Service)
-					if f.IsFlapping(event.message.Service, false) {
-						Logger().Info.Printf("PUSH sending state '%s' for flapping service '%s' upstream",
-							stateName(stateCritical), event.message.Service)
-					}
-					g.registry.update(event.message)
-				}
-			}
-		} else {
-			// no previous message, store
-			g.registry.update(event.message)
+		g.handleMessage(event.message)
+	} else if event.initBufferExpiry != nil {
+		g.handleInitBufferExpiry(event.initBufferExpiry.key)
+	} else if event.stateExpiry != nil {
+		g.handleStateExpiry(event.stateExpiry.key)
+	} else if event.freshnessExpiry != nil {
+		g.handleFreshnessExpiry(event.freshnessExpiry.key)
+	}
+}
+
+/*
+ * The event is an incoming message. All incoming messages should be buffered for a small
+ * period of time to make sure we're not thrashing (flip-flopping). However we have to be careful
+ * so that a flooding scenario doesn't cause us to stall indefinitely. Thus the following rules
+ * can be applied:
+ *   - if no previous service alert (or it expired), store and start buffering
+ *   - if previous service alert with same state (OK, WARN, etc), discard current message, only
+ *     note that the service is still reporting (don't restart the init buffer). Unless upstream
+ *     was told something else, then buffer it again. Or unless the output changed enough to be
+ *     worth sending (see dedup.go), then forward it
+ *   - if previous service alert is different:
+ *     - update flap counter, raise alert if service is flapping
+ *     - store message, restart buffering
+ *
+ * The exception is a service that went stale (see freshness.go). A CRITICAL was sent on its
+ * behalf so whatever it reports now is sent upstream straight away.
+ */
+func (g *Gateway) handleMessage(message *Message) {
+	entry := g.registry.getEntry(message.key())
+
+	if entry != nil && entry.freshnessAlerted {
+		entry = g.registry.update(message)
+		g.forward(entry, message, "service reported again after going stale")
+		return
+	}
+
+	if entry == nil || entry.message == nil || entry.phase == phaseExpired || entry.phase == phaseTombstoned {
+		// no previous message, store
+		entry = g.registry.update(message)
+		g.decision(ruleBuffered, entry, message, nil)
+		if Config().TraceLogging {
+			// the summary covers the whole registry, don't build it just to discard it
 			Logger().Trace.Printf("registry:\n%s\n", g.registry.summaryString())
 		}
+		return
+	}
 
-	} else if event.initBufferExpiry != nil {
-		/*
-		 * All messages are given an initial buffering time. This event is raised when that time is up.
-		 * At this point we need to make a decision based on the sate of the message. In general we do:
-		 *   - if previous state is different, proxy
-		 *   - if previous state is the same, do nothing
-		 *   - if previous state does not exist (expired or new), proxy
-		 */
-		if message := g.registry.get(event.initBufferExpiry.service); message != nil {
-			if previous := g.registry.getPrev(event.initBufferExpiry.service); previous != nil {
-				if message.State != previous.State {
-					Logger().Info.Printf("detected state change from %s to %s for service %s",
-						stateName(previous.State), stateName(message.State), message.Service)
+	if entry.message.State == message.State {
+		if pending, known := entry.pendingState(); entry.phase == phaseBuffering || (known && pending == message.State) {
+			now := g.clock.Now()
+			if entry.phase == phaseDecided && entry.held == nil {
+				dedup := Config().dedupFor(entry.policyAt(now))
+				if why := dedup.significantChange(entry.upstreamMessage, message); why != "" {
+					g.registry.refresh(entry, message, now)
+					g.forward(entry, message, why)
+					return
 				}
-			} else {
-				Logger().Info.Printf("new state of %s for service %s, sending upstream",
-					stateName(message.State), message.Service)
 			}
+			// same state, discard
+			g.registry.refresh(entry, message, now)
+			g.decision(ruleDiscardedDuplicate, entry, message, nil)
+			return
 		}
-	} else if event.stateExpiry != nil {
-		/*
-		 * An alert is cached based on it's last recorded state. When a service has not had any activity
-		 * in a while, it will eventually expire with it's last known state. That is when this event is raised
-		 * and we can take action on it. If an event expires in an error-state, we can set it back to a
-		 * non-error state.
-		 *
-		 * A non-error state is defined as OK here.
-		 */
-		if message := g.registry.get(event.stateExpiry.service); message != nil {
-			Logger().Info.Printf("expired message: %v with state %s\n", message, stateName(message.State))
-			switch message.State {
-			case stateOk: // do nothing
-			case stateWarning:
-				fallthrough
-			case stateCritical:
-				Logger().Info.Printf("PUSH Sending state '%s' for expired service '%s' upstream",
-					stateName(stateOk), message.Service)
-			default:
-				Logger().Trace.Println("Expired message in UNKNOWN state")
+		// same state as before, but not what upstream has (e.g. a worse state was sent for the
+		// buffer), buffer it again so upstream catches up
+		g.registry.buffer(entry, message, g.clock.Now())
+		g.decision(ruleBuffered, entry, message, nil)
+		return
+	}
+
+	// different state
+	entry.flap.NoteStateChange(message.Service)
+	if entry.flap.IsFlapping(message.Service, false) {
+		g.decision(ruleFlap, entry, message, &Notification{
+			Message: newSynthesizedMessage(message, stateCritical,
+				"service is flapping, last output: "+message.Message, message.Timestamp),
+			Reason:      "flapping",
+			Synthesized: true,
+		})
+	}
+	g.registry.buffer(entry, message, g.clock.Now())
+	g.decision(ruleBuffered, entry, message, nil)
+}
+
+/*
+ * All messages are given an initial buffering time. This event is raised when that time is up.
+ * At this point we need to make a decision based on the state of the message compared to what
+ * the upstream was last told. In general we do:
+ *   - if upstream state is different, proxy
+ *   - if upstream state is the same, do nothing
+ *   - if upstream state is not known (new service, or its tombstone was collected), proxy
+ * Recoveries (OK after non-OK) that have a recovery hold keep buffering for the hold first.
+ */
+func (g *Gateway) handleInitBufferExpiry(key string) {
+	now := g.clock.Now()
+	entry := g.registry.getEntry(key)
+	if entry == nil {
+		return
+	}
+
+	// what is sent depends on the buffer aggregation mode (see aggregation.go)
+	policy := entry.policyAt(now)
+	message := entry.buffered.aggregate(Config().bufferAggregationFor(policy), entry.message)
+
+	// recoveries may have to hold a while longer (see recovery.go)
+	if hold := Config().recoveryHoldFor(policy); hold > 0 && isRecovery(entry, message) &&
+		g.registry.holdRecovery(entry, hold, now) {
+		Logger().Info.Printf("holding recovery of service %s for %v", message.Service, hold)
+		g.decision(ruleRecoveryHeld, entry, message, nil)
+		return
+	}
+
+	if !g.registry.decide(entry, now) {
+		return
+	}
+	if !entry.upstreamKnown {
+		Logger().Info.Printf("new state of %s for service %s, sending upstream",
+			stateName(message.State), message.Service)
+		g.forward(entry, message, "new service")
+	} else if message.State != entry.upstreamState {
+		Logger().Info.Printf("detected state change from %s to %s for service %s",
+			stateName(entry.upstreamState), stateName(message.State), message.Service)
+		g.forward(entry, message, "state changed")
+	} else {
+		Logger().Trace.Printf("state of service %s is unchanged (%s)", message.Service, stateName(message.State))
+		g.decision(ruleUnchanged, entry, message, nil)
+	}
+}
+
+/*
+ * An alert is cached based on it's last recorded state. When a service has not had any activity
+ * in a while, it will eventually expire with it's last known state. That is when this event is raised
+ * and we can take action on it. What action is taken depends on the expiry policy for the service
+ * (see expiry.go). By default an expired error-state is set back to OK. A service that went
+ * stale (see freshness.go) is not: upstream was told it is CRITICAL for being silent, and it
+ * still is.
+ *
+ * Unless the policy is sticky, the entry is then tombstoned.
+ */
+func (g *Gateway) handleStateExpiry(key string) {
+	now := g.clock.Now()
+	entry := g.registry.getEntry(key)
+	if entry == nil || !g.registry.expire(entry, now) {
+		return
+	}
+
+	message := entry.message
+	Logger().Info.Printf("expired message: %v with state %s\n", message, stateName(message.State))
+	policy := Config().expiryPolicyFor(entry.policyAt(now))
+	n, err := policy.notification(message, entry.receivedAt, now)
+	if err != nil {
+		Logger().Error.Println(err)
+	} else if entry.freshnessAlerted {
+		Logger().Trace.Printf("service '%s' is stale, its expiry sends nothing\n", message.Service)
+		n = nil
+	} else if n == nil {
+		Logger().Trace.Printf("expiry action '%s' sends nothing for service '%s' in state %s\n",
+			policy.Action, message.Service, stateName(message.State))
+	}
+	g.decision(ruleExpiry, entry, message, n)
+
+	if policy.Action != expiryActionSticky {
+		g.registry.tombstone(entry, now)
+	}
+}
+
+/*
+ * The service is expected to report on an interval and it missed it. Silence is considered
+ * a failure for these services so a CRITICAL is sent upstream on its behalf.
+ */
+func (g *Gateway) handleFreshnessExpiry(key string) {
+	entry := g.registry.getEntry(key)
+	if entry == nil {
+		return
+	}
+	Logger().Info.Printf("service '%s' on host '%s' missed its expected reporting interval of %s\n",
+		entry.service, entry.host, entry.freshnessInterval)
+	g.decision(ruleFreshness, entry, entry.message, staleNotification(entry, g.clock.Now()))
+}
+
+// forward sends a message received from a client upstream
+func (g *Gateway) forward(entry *MessageEntry, message *Message, reason string) {
+	g.decision(ruleForwarded, entry, message, &Notification{Message: message, Reason: reason})
+}
+
+// decision - acts on a decision the gateway made about an entry. If n is not nil it is sent
+// upstream, held (see hold.go), collected by a digest (see digest.go), or dropped if a rollup
+// suppresses it (see rollup.go). Either way the decision is written to the audit log.
+func (g *Gateway) decision(rule string, entry *MessageEntry, message *Message, n *Notification) {
+	now := g.clock.Now()
+	var err error
+	var h *hold
+	var suppressedBy *Rollup
+	var digest *digestState
+	if n != nil {
+		n.Route = Config().upstreamFor(entry.policyAt(now))
+		if suppressedBy = Config().suppressingRollup(entry.host, entry.service); suppressedBy != nil {
+			Logger().Trace.Printf("not sending state '%s' for service '%s', suppressed by %s\n",
+				stateName(n.Message.State), entry.service, suppressedBy)
+		} else if digest = g.digestFor(entry, n, now); digest != nil {
+			digest.collect(entry, n, now)
+		} else {
+			g.noteStormResult(rule, entry, n, now)
+			if h = g.holdFor(entry, n, now); h != nil {
+				g.holdBack(entry, n, h)
+			} else {
+				err = g.push(n)
 			}
 		}
+	} else if rule == ruleUnchanged {
+		// upstream already has the true state, nothing to send once no longer held
+		entry.held = nil
+	}
+	if g.auditLog != nil {
+		record := newAuditRecord(now, rule, entry, message, n, err)
+		if h != nil {
+			record.Upstream = upstreamHeld
+			record.Reason += fmt.Sprintf(" (held by %s)", h.by)
+		} else if suppressedBy != nil {
+			record.Upstream = upstreamSuppressed
+			record.Reason += fmt.Sprintf(" (suppressed by %s)", suppressedBy)
+		} else if digest != nil {
+			record.Upstream = upstreamDigested
+			record.Reason += fmt.Sprintf(" (collected by %s)", digest)
+		}
+		if err := g.auditLog.record(record); err != nil {
+			Logger().Warning.Println("Failed to write audit record", err.Error())
+		}
+	}
+	if n != nil && h == nil && err == nil {
+		// the digest stands in for upstream, the service is sent as usual once it is done with it.
+		// So does the rollup suppressing the service, its unchanged results are not decided again.
+		g.registry.noteUpstream(entry, n.Message.State)
+		entry.held = nil
+		entry.digested = digest != nil
+		entry.upstreamMessage = nil
+		if !n.Synthesized {
+			// what the client reported, rather than the output as changed on the way up
+			entry.upstreamMessage = entry.message
+		}
+	}
+	g.updateHost(entry, now)
+}
+
+// push sends a notification upstream
+func (g *Gateway) push(n *Notification) error {
+	err := g.upstream.Send(n)
+	if err != nil {
+		Logger().Error.Printf("failed to send state '%s' for service '%s' upstream: %v\n",
+			stateName(n.Message.State), n.Message.Service, err)
 	}
+	return err
 }
 
 func newGateway(r *Registry, incomingEventChan chan *GatewayEvent) *Gateway {
 	g := &Gateway{
 		registry:          r,
 		incomingEventChan: incomingEventChan,
+		upstream:          logUpstream{},
+		clock:             r.clock,
+		held:              make(map[string]*MessageEntry),
+		storms:            newStormStates(Config().Storms, r.clock.Now()),
+		digests:           newDigestStates(Config().Digests, r.clock.Now()),
+		enqueueTimeout:    time.Duration(Config().GatewayEnqueueTimeoutInMillis) * time.Millisecond,
 	}
 	return g
 }
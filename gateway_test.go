@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/JohnMurray/nbad/clock"
+)
+
+// recordingUpstream keeps every notification it is sent
+type recordingUpstream struct {
+	sent []*Notification
+}
+
+func (u *recordingUpstream) Send(n *Notification) error {
+	u.sent = append(u.sent, n)
+	return nil
+}
+
+func newTestGateway(t *testing.T, c *NbadConfig) (*Gateway, *recordingUpstream, *clock.Fake) {
+	useTestConfig(t, c)
+	clk := clock.NewFake(time.Unix(1000, 0))
+	upstream := &recordingUpstream{}
+	g := newGateway(newTestRegistry(clk), make(chan *GatewayEvent, 100))
+	g.upstream = upstream
+	return g, upstream, clk
+}
+
+func TestInitBufferExpiryForwardsExactlyOnce(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10})
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateCritical})
+	entry := g.registry.getEntry(registryKey("h", "s"))
+
+	after(g, clk, 9*time.Second)
+	if len(upstream.sent) != 0 {
+		t.Errorf("Nothing should be sent while buffering")
+	}
+
+	after(g, clk, time.Second)
+	after(g, clk, 0)
+	after(g, clk, time.Second)
+
+	if len(upstream.sent) != 1 || upstream.sent[0].Message.State != stateCritical {
+		t.Fatalf("Expected exactly one CRITICAL upstream, got %d notifications", len(upstream.sent))
+	}
+	if entry.phase != phaseDecided {
+		t.Errorf("Expected entry to be %s, was %s", phaseDecided, entry.phase)
+	}
+}
+
+func TestStateChangeDuringBufferRestartsIt(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10})
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateCritical})
+	after(g, clk, 8*time.Second)
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateOk})
+
+	after(g, clk, 8*time.Second)
+	if len(upstream.sent) != 0 {
+		t.Errorf("Nothing should be sent while the restarted buffer is running")
+	}
+	after(g, clk, 2*time.Second)
+	if len(upstream.sent) != 1 || upstream.sent[0].Message.State != stateOk {
+		t.Errorf("Expected only the final OK to be sent, got %d notifications", len(upstream.sent))
+	}
+}
+
+func TestStateExpiryFiresExactlyOnceAndTombstones(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10})
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateCritical})
+	entry := g.registry.getEntry(registryKey("h", "s"))
+	after(g, clk, 10*time.Second)
+
+	after(g, clk, 50*time.Second)
+	for i := 0; i < 5; i++ {
+		after(g, clk, 100*time.Millisecond)
+	}
+
+	if len(upstream.sent) != 2 || upstream.sent[1].Message.State != stateOk || !upstream.sent[1].Synthesized {
+		t.Fatalf("Expected one CRITICAL then exactly one synthesized OK, got %d notifications", len(upstream.sent))
+	}
+	if entry.phase != phaseTombstoned {
+		t.Errorf("Expected entry to be %s, was %s", phaseTombstoned, entry.phase)
+	}
+
+	after(g, clk, time.Hour)
+	if g.registry.getEntry(registryKey("h", "s")) != nil {
+		t.Errorf("Expected tombstone to be collected after the tombstone ttl")
+	}
+}
+
+func TestStickyExpiryKeepsEntryExpired(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{
+		FlapCountThreshold:           5,
+		MessageInitBufferTimeSeconds: 10,
+		ExpiryAction:                 expiryActionSticky,
+	})
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateCritical})
+	entry := g.registry.getEntry(registryKey("h", "s"))
+	after(g, clk, 10*time.Second)
+	after(g, clk, 50*time.Second)
+	after(g, clk, 2*time.Hour)
+
+	if len(upstream.sent) != 1 {
+		t.Errorf("Expected only the initial CRITICAL to be sent, got %d notifications", len(upstream.sent))
+	}
+	if entry.phase != phaseExpired {
+		t.Errorf("Expected sticky entry to stay %s, was %s", phaseExpired, entry.phase)
+	}
+}
+
+func TestReturningServiceComparedToTombstonedUpstreamState(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{
+		FlapCountThreshold:           5,
+		MessageInitBufferTimeSeconds: 10,
+		ExpiryAction:                 expiryActionNone,
+	})
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateCritical})
+	after(g, clk, 10*time.Second)
+	after(g, clk, 50*time.Second)
+
+	// upstream still has CRITICAL, so the same state coming back is not news
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateCritical})
+	after(g, clk, 10*time.Second)
+
+	if len(upstream.sent) != 1 {
+		t.Errorf("Expected returning service in the same state not to be re-sent, got %d notifications",
+			len(upstream.sent))
+	}
+}
+
+func TestDuplicateMessageDoesNotRestartInitBuffer(t *testing.T) {
+	g, _, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10})
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateWarning})
+	entry := g.registry.getEntry(registryKey("h", "s"))
+	bufferExpireAt := entry.initBufferExpireAt
+	expireAt := entry.expireAt
+
+	clk.Advance(5 * time.Second)
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateWarning})
+
+	if entry.initBufferExpireAt != bufferExpireAt {
+		t.Errorf("Duplicate state should not restart the init buffer")
+	}
+	if !entry.expireAt.After(expireAt) {
+		t.Errorf("Duplicate state should note that the service is still reporting")
+	}
+}
+
+func TestFlappingServiceSendsCritical(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 3, MessageInitBufferTimeSeconds: 10})
+	states := []uint16{stateOk, stateCritical, stateOk, stateCritical}
+	for _, state := range states {
+		g.handleMessage(&Message{Host: "h", Service: "s", State: state})
+		after(g, clk, time.Second)
+	}
+
+	if len(upstream.sent) != 1 || upstream.sent[0].Reason != "flapping" {
+		t.Fatalf("Expected a single flapping notification, got %d notifications", len(upstream.sent))
+	}
+	if upstream.sent[0].Message.State != stateCritical {
+		t.Errorf("Expected flapping service to be sent as CRITICAL")
+	}
+}
+
+func TestFreshnessExpiryFiresOnceAndRecovers(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{
+		FlapCountThreshold:           5,
+		MessageInitBufferTimeSeconds: 10,
+		ExpiryAction:                 expiryActionSticky,
+	})
+	g.registry.expect("h", "heartbeat", 5*time.Minute)
+
+	after(g, clk, 5*time.Minute)
+	after(g, clk, time.Minute)
+	if len(upstream.sent) != 1 || upstream.sent[0].Message.State != stateCritical {
+		t.Fatalf("Expected exactly one CRITICAL for the silent service, got %d notifications", len(upstream.sent))
+	}
+
+	g.handleMessage(&Message{Host: "h", Service: "heartbeat", State: stateOk})
+	if len(upstream.sent) != 2 || upstream.sent[1].Message.State != stateOk {
+		t.Errorf("Expected the service reporting again to be sent straight away")
+	}
+}
+
+func TestExpiryDoesNotBlockOnFullIngestBuffer(t *testing.T) {
+	useTestConfig(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10})
+	clk := clock.NewFake(time.Unix(1000, 0))
+	g := newGateway(newTestRegistry(clk), make(chan *GatewayEvent, 1))
+	g.upstream = &recordingUpstream{}
+	for i := 0; i < 10; i++ {
+		g.handleMessage(&Message{Host: "h", Service: fmt.Sprintf("s%d", i), State: stateCritical})
+	}
+	clk.Advance(10 * time.Second)
+	// nobody is draining the channel while expiry runs, and it's already full
+	g.incomingEventChan <- newMessageEvent(&Message{Host: "h", Service: "z", State: stateOk})
+
+	done := make(chan struct{})
+	go func() {
+		g.expireOldMessages()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expiring messages blocked on the gateway's own channel")
+	}
+}
+
+func TestEnqueueDropsWhenBufferIsFull(t *testing.T) {
+	useTestConfig(t, &NbadConfig{GatewayEnqueueTimeoutInMillis: 10})
+	g := newGateway(newTestRegistry(clock.Real), make(chan *GatewayEvent, 1))
+
+	if !g.enqueue(&Message{Host: "h", Service: "a"}) {
+		t.Errorf("Expected message to be enqueued while there is room")
+	}
+	start := time.Now()
+	if g.enqueue(&Message{Host: "h", Service: "b"}) {
+		t.Errorf("Expected message to be dropped when the buffer is full")
+	}
+	if time.Since(start) < 10*time.Millisecond {
+		t.Errorf("Expected enqueue to wait for the timeout before dropping")
+	}
+	if g.dropped != 1 {
+		t.Errorf("Expected 1 dropped message to be counted, got %d", g.dropped)
+	}
+}
+
+func newBenchmarkGateway(b *testing.B, services int, rollups ...*Rollup) *Gateway {
+	nbadConfig = &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10, MessageCacheTTLInSeconds: 60,
+		Rollups: rollups}
+	if err := nbadConfig.compile(); err != nil {
+		b.Fatal(err)
+	}
+	g := newGateway(newRegistry(60, 10, 3600, clock.Real), make(chan *GatewayEvent, 1))
+	g.upstream = &recordingUpstream{}
+	for i := 0; i < services; i++ {
+		g.handleMessage(&Message{Host: fmt.Sprintf("host-%d", i), Service: "api-health", State: stateOk})
+	}
+	return g
+}
+
+func BenchmarkExpireOldMessagesNothingDue100k(b *testing.B) {
+	g := newBenchmarkGateway(b, 100000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.expireOldMessages()
+	}
+}
+
+func BenchmarkHandleStateChange100k(b *testing.B) {
+	g := newBenchmarkGateway(b, 100000)
+	states := []uint16{stateWarning, stateOk}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.handleMessage(&Message{Host: fmt.Sprintf("host-%d", i%100000), Service: "api-health", State: states[(i/100000)%2]})
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+/**
+ * File: graphite.go
+ *
+ * nbad sees every check result before Nagios does, so it can feed Graphite directly. The
+ * exporter writes the state (0-3) and the perfdata values (under "perfdata.<label>") of every
+ * result it receives (after the transform stage, see transform.go) to a carbon plaintext
+ * endpoint:
+ *
+ *    <path> <value> <timestamp>
+ *
+ * The path is a text/template, see graphiteTemplateData. Lines are sent in batches, once
+ * graphite_batch_size lines are waiting or graphite_flush_interval_in_millis after the first
+ * one. When carbon can't be reached the exporter reconnects with a backoff (doubling up to a
+ * minute) and keeps up to graphite_max_pending lines meanwhile, dropping the oldest beyond that.
+ * Exporting never slows down the processing of check results, lines that don't fit into the
+ * exporter's queue are dropped.
+ */
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultGraphiteTemplate            = "nbad.{{.Host}}.{{.Service}}.{{.Metric}}"
+	defaultGraphiteBatchSize           = 500
+	defaultGraphiteFlushIntervalMillis = 1000
+	defaultGraphiteMaxPending          = 10000
+
+	// graphiteStateMetric is the metric name of the state of results
+	graphiteStateMetric = "state"
+	// graphitePerfdataPrefix is put in front of the perfdata labels, so that they can't collide
+	// with the state
+	graphitePerfdataPrefix = "perfdata."
+
+	graphiteDialTimeout  = 5 * time.Second
+	graphiteWriteTimeout = 10 * time.Second
+	graphiteMinBackoff   = time.Second
+	graphiteMaxBackoff   = time.Minute
+)
+
+// graphiteUnsafe matches what can't be part of a path component
+var graphiteUnsafe = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// graphiteTemplateData holds the values available to the path template, with anything but
+// letters, digits, '_' and '-' replaced by '_'
+type graphiteTemplateData struct {
+	Host    string
+	Service string
+	// Metric is "state" or "perfdata.<label>" (only the label is sanitized)
+	Metric string
+}
+
+// newGraphiteTemplate - compiles the path template, an empty template falls back to the default
+func newGraphiteTemplate(path string) (*template.Template, error) {
+	if path == "" {
+		path = defaultGraphiteTemplate
+	}
+	tmpl, err := template.New("graphite").Parse(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse graphite template: %v", err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, &graphiteTemplateData{"host", "service", "metric"}); err != nil {
+		return nil, fmt.Errorf("invalid graphite template: %v", err)
+	}
+	if buf.Len() == 0 || strings.ContainsAny(buf.String(), " \t\n") {
+		return nil, fmt.Errorf("invalid graphite template '%s': paths can't be empty or contain whitespace", path)
+	}
+	return tmpl, nil
+}
+
+// GraphiteExporter writes the states and perfdata of check results to carbon
+type GraphiteExporter struct {
+	address       string
+	path          *template.Template
+	batchSize     int
+	flushInterval time.Duration
+	maxPending    int
+	minBackoff    time.Duration
+
+	lines chan string
+	done  chan struct{}
+
+	// only used by run()
+	conn        net.Conn
+	pending     []string
+	backoff     time.Duration
+	nextAttempt time.Time
+	dropped     int
+}
+
+// newConfiguredGraphiteExporter - creates an exporter from the config and starts it, nil if
+// graphite_address isn't set
+func newConfiguredGraphiteExporter() *GraphiteExporter {
+	c := Config()
+	if c.GraphiteAddress == "" {
+		return nil
+	}
+	e := newGraphiteExporter(c.GraphiteAddress, c.graphitePath, int(c.GraphiteBatchSize),
+		time.Duration(c.GraphiteFlushIntervalInMillis)*time.Millisecond, int(c.GraphiteMaxPending))
+	go e.run()
+	return e
+}
+
+func newGraphiteExporter(address string, path *template.Template, batchSize int, flushInterval time.Duration,
+	maxPending int) *GraphiteExporter {
+	return &GraphiteExporter{
+		address:       address,
+		path:          path,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		maxPending:    maxPending,
+		minBackoff:    graphiteMinBackoff,
+		lines:         make(chan string, maxPending),
+		done:          make(chan struct{}),
+	}
+}
+
+// format returns the carbon lines for the message: its state, then its (known) perfdata values
+func (e *GraphiteExporter) format(m *Message, now time.Time) []string {
+	timestamp := now.Unix()
+	if m.Timestamp != 0 {
+		timestamp = int64(m.Timestamp)
+	}
+	lines := []string{e.line(m, graphiteStateMetric, float64(m.State), timestamp)}
+	for _, v := range m.parsed().Perfdata {
+		if !v.Unknown {
+			metric := graphitePerfdataPrefix + graphiteUnsafe.ReplaceAllString(v.Label, "_")
+			lines = append(lines, e.line(m, metric, v.Value, timestamp))
+		}
+	}
+	return lines
+}
+
+func (e *GraphiteExporter) line(m *Message, metric string, value float64, timestamp int64) string {
+	var path bytes.Buffer
+	e.path.Execute(&path, &graphiteTemplateData{
+		Host:    graphiteUnsafe.ReplaceAllString(m.Host, "_"),
+		Service: graphiteUnsafe.ReplaceAllString(m.Service, "_"),
+		Metric:  metric,
+	})
+	return fmt.Sprintf("%s %s %d\n", path.String(), strconv.FormatFloat(value, 'f', -1, 64), timestamp)
+}
+
+// export - queues the lines for the message, dropping what doesn't fit. Safe to call from
+// multiple goroutines.
+func (e *GraphiteExporter) export(m *Message, now time.Time) {
+	for _, line := range e.format(m, now) {
+		select {
+		case e.lines <- line:
+		default:
+			Logger().Trace.Printf("graphite queue is full, dropping metrics of service '%s'\n", m.Service)
+			return
+		}
+	}
+}
+
+// close - sends what is pending (if carbon can be reached) and stops the exporter
+func (e *GraphiteExporter) close() {
+	close(e.lines)
+	<-e.done
+}
+
+// run - batches queued lines and writes them to carbon until the exporter is closed
+func (e *GraphiteExporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case line, ok := <-e.lines:
+			if !ok {
+				e.flush(time.Now())
+				if e.conn != nil {
+					e.conn.Close()
+				}
+				return
+			}
+			e.pending = append(e.pending, line)
+			if len(e.pending) > e.maxPending {
+				e.dropped += len(e.pending) - e.maxPending
+				e.pending = e.pending[len(e.pending)-e.maxPending:]
+			}
+			if len(e.pending) >= e.batchSize {
+				e.flush(time.Now())
+			}
+		case now := <-ticker.C:
+			e.flush(now)
+		}
+	}
+}
+
+// flush - writes the pending lines in batches, connecting first if needed. Lines that could
+// not be written are kept for the next attempt.
+func (e *GraphiteExporter) flush(now time.Time) {
+	if e.dropped > 0 {
+		Logger().Warning.Printf("dropped %d graphite metrics while carbon at '%s' was unreachable\n", e.dropped, e.address)
+		e.dropped = 0
+	}
+	for len(e.pending) > 0 {
+		if e.conn == nil && !e.connect(now) {
+			return
+		}
+		n := len(e.pending)
+		if n > e.batchSize {
+			n = e.batchSize
+		}
+		e.conn.SetWriteDeadline(now.Add(graphiteWriteTimeout))
+		if _, err := e.conn.Write([]byte(strings.Join(e.pending[:n], ""))); err != nil {
+			Logger().Warning.Printf("could not write to carbon at '%s': %v\n", e.address, err)
+			e.conn.Close()
+			e.conn = nil
+			e.retryLater(now)
+			return
+		}
+		e.pending = e.pending[n:]
+	}
+	e.pending = nil
+}
+
+// connect returns true if the exporter is connected to carbon, it only tries once the backoff
+// after the last failure is over
+func (e *GraphiteExporter) connect(now time.Time) bool {
+	if now.Before(e.nextAttempt) {
+		return false
+	}
+	conn, err := net.DialTimeout("tcp", e.address, graphiteDialTimeout)
+	if err != nil {
+		Logger().Warning.Printf("could not connect to carbon at '%s': %v\n", e.address, err)
+		e.retryLater(now)
+		return false
+	}
+	Logger().Info.Printf("Connected to carbon at '%s'\n", e.address)
+	e.conn = conn
+	e.backoff = 0
+	return true
+}
+
+// retryLater - doubles the backoff (up to graphiteMaxBackoff) before the next connection attempt
+func (e *GraphiteExporter) retryLater(now time.Time) {
+	if e.backoff == 0 {
+		e.backoff = e.minBackoff
+	} else if e.backoff *= 2; e.backoff > graphiteMaxBackoff {
+		e.backoff = graphiteMaxBackoff
+	}
+	e.nextAttempt = now.Add(e.backoff)
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listenCarbon - accepts connections on a local address and sends every line received to the
+// channel, until stop is called (which also closes the connections)
+func listenCarbon(t *testing.T, address string) (string, chan string, func()) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := make(chan string, 100)
+	conns := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conns <- conn
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+	stop := func() {
+		listener.Close()
+		for {
+			select {
+			case conn := <-conns:
+				conn.Close()
+			default:
+				return
+			}
+		}
+	}
+	return listener.Addr().String(), lines, stop
+}
+
+func receiveLine(t *testing.T, lines chan string) string {
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expected a line to be received by carbon")
+	}
+	return ""
+}
+
+func TestGraphiteFormat(t *testing.T) {
+	path, err := newGraphiteTemplate("checks.{{.Host}}.{{.Service}}.{{.Metric}}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := newGraphiteExporter("localhost:0", path, 10, time.Second, 10)
+	m := &Message{Host: "web1.example.com", Service: "disk usage", State: stateWarning, Timestamp: 1000,
+		Message: "DISK WARNING | /var=81%;80;90 inodes=U"}
+	lines := e.format(m, time.Unix(2000, 0))
+	expected := []string{
+		"checks.web1_example_com.disk_usage.state 1 1000\n",
+		"checks.web1_example_com.disk_usage.perfdata._var 81 1000\n",
+	}
+	if strings.Join(lines, "") != strings.Join(expected, "") {
+		t.Errorf("Unexpected lines %q", lines)
+	}
+
+	m = &Message{Host: "h", Service: "s", Message: "OK | time=0.25s"}
+	if lines := e.format(m, time.Unix(2000, 0)); len(lines) != 2 || lines[1] != "checks.h.s.perfdata.time 0.25 2000\n" {
+		t.Errorf("Expected the time received for results without a timestamp, got %q", lines)
+	}
+
+	// a label that looks like the state stays apart from it
+	m = &Message{Host: "h", Service: "s", State: stateOk, Timestamp: 1000, Message: "OK | state=5 s.t=1"}
+	expected = []string{"checks.h.s.state 0 1000\n", "checks.h.s.perfdata.state 5 1000\n", "checks.h.s.perfdata.s_t 1 1000\n"}
+	if lines := e.format(m, time.Unix(2000, 0)); strings.Join(lines, "") != strings.Join(expected, "") {
+		t.Errorf("Expected perfdata under its own prefix, got %q", lines)
+	}
+}
+
+func TestGraphiteTemplateIsValidated(t *testing.T) {
+	for _, tmpl := range []string{"nbad.{{.Host", "{{.Nope}}", "nbad {{.Host}}"} {
+		if _, err := newGraphiteTemplate(tmpl); err == nil {
+			t.Errorf("Expected template '%s' to be rejected", tmpl)
+		}
+	}
+	if _, err := newGraphiteTemplate(""); err != nil {
+		t.Errorf("Expected the default template to be used, got %v", err)
+	}
+}
+
+func TestGraphiteBatching(t *testing.T) {
+	useTestConfig(t, &NbadConfig{})
+	address, lines, stop := listenCarbon(t, "localhost:0")
+	defer stop()
+
+	path, _ := newGraphiteTemplate("")
+	e := newGraphiteExporter(address, path, 3, time.Hour, 100)
+	go e.run()
+
+	// a full batch is sent straight away, without waiting for the flush interval
+	e.export(&Message{Host: "h", Service: "s", Timestamp: 1000, Message: "OK | a=1 b=2"}, time.Now())
+	for _, expected := range []string{"nbad.h.s.state 0 1000", "nbad.h.s.perfdata.a 1 1000", "nbad.h.s.perfdata.b 2 1000"} {
+		if line := receiveLine(t, lines); line != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, line)
+		}
+	}
+
+	// what is left is sent when the exporter is closed
+	e.export(&Message{Host: "h", Service: "s", Timestamp: 1001, Message: "OK"}, time.Now())
+	select {
+	case line := <-lines:
+		t.Errorf("Expected a partial batch to wait, got '%s'", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+	e.close()
+	if line := receiveLine(t, lines); line != "nbad.h.s.state 0 1001" {
+		t.Errorf("Expected the pending line to be sent on close, got '%s'", line)
+	}
+}
+
+func TestGraphiteReconnects(t *testing.T) {
+	useTestConfig(t, &NbadConfig{})
+	address, lines, stop := listenCarbon(t, "localhost:0")
+
+	path, _ := newGraphiteTemplate("")
+	e := newGraphiteExporter(address, path, 1, 10*time.Millisecond, 100)
+	e.minBackoff = 10 * time.Millisecond
+	go e.run()
+	defer e.close()
+
+	e.export(&Message{Host: "h", Service: "s", Timestamp: 1000}, time.Now())
+	receiveLine(t, lines)
+
+	// carbon goes away and comes back on the same address
+	stop()
+	e.export(&Message{Host: "h", Service: "s", Timestamp: 1001}, time.Now())
+	time.Sleep(50 * time.Millisecond)
+	_, lines, stop = listenCarbon(t, address)
+	defer stop()
+
+	// the first writes after carbon went away may get lost, the exporter has to reconnect
+	deadline := time.Now().Add(2 * time.Second)
+	for ts := uint32(1002); time.Now().Before(deadline); ts++ {
+		e.export(&Message{Host: "h", Service: "s", Timestamp: ts}, time.Now())
+		select {
+		case <-lines:
+			return
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	t.Errorf("Expected the exporter to reconnect to carbon")
+}
+
+func TestGraphiteQueueIsBounded(t *testing.T) {
+	useTestConfig(t, &NbadConfig{})
+	path, _ := newGraphiteTemplate("")
+	// nothing listens on the address
+	listener, _ := net.Listen("tcp", "localhost:0")
+	address := listener.Addr().String()
+	listener.Close()
+
+	e := newGraphiteExporter(address, path, 100, time.Hour, 2)
+	for ts := uint32(1000); ts < 1005; ts++ {
+		e.export(&Message{Host: "h", Service: "s", Timestamp: ts}, time.Now())
+	}
+	if len(e.lines) != 2 {
+		t.Errorf("Expected lines beyond the queue size to be dropped, %d queued", len(e.lines))
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+/**
+ * File: hold.go
+ *
+ * Rather than being sent, what the gateway decides to tell upstream can be held on the entry:
+ *
+ *   - while the service is silenced (see silence.go)
+ *   - while a non-OK result's host is down (see host.go)
+ *   - while the service's group is in an alert storm (see storm.go)
+ *   - while a non-OK result's parent is failing, for dependencies that hold (see dependency.go)
+ *
+ * Only the last held notification is kept, and it is dropped when a later decision finds that
+ * upstream already has the true state. Held entries are checked on every tick of the gateway,
+ * once nothing holds them any more what they held is sent, unless upstream already has that
+ * state.
+ */
+
+import (
+	"fmt"
+	"time"
+)
+
+// hold is why a notification is held back
+type hold struct {
+	// by - what holds the notification (for logs and the audit log)
+	by string
+	// rule - what the decision is recorded as once the notification is released
+	rule string
+	// reason - prepended to the notification's reason once it is released
+	reason string
+	// host - held because the host is down
+	host bool
+}
+
+// holdFor returns what holds back the notification for the entry, nil if nothing does.
+// Dependencies that annotate rather than hold add their note to the notification.
+func (g *Gateway) holdFor(entry *MessageEntry, n *Notification, now time.Time) *hold {
+	if g.silences != nil {
+		if s := g.silences.matching(entry.host, entry.service, now); s != nil {
+			return &hold{by: "silence " + s.ID, rule: ruleSilenceEnded, reason: "silence ended"}
+		}
+	}
+	if h := g.hostHold(entry, n); h != nil {
+		return h
+	}
+	if h := g.stormHold(entry); h != nil {
+		return h
+	}
+	if n.Message.State == stateOk {
+		return nil
+	}
+	if d, parentState := g.failingParent(entry); d != nil {
+		if d.Action == dependencyAnnotate {
+			annotateDependency(n, d, parentState)
+			return nil
+		}
+		return &hold{
+			by:     fmt.Sprintf("parent %s/%s being %s", d.ParentHost, d.ParentService, stateName(parentState)),
+			rule:   ruleParentRecovered,
+			reason: "parent recovered",
+		}
+	}
+	return nil
+}
+
+// holdBack keeps the notification on the entry until 'releaseHeld' finds nothing holds it
+func (g *Gateway) holdBack(entry *MessageEntry, n *Notification, h *hold) {
+	Logger().Info.Printf("holding state '%s' for service '%s', held by %s\n",
+		stateName(n.Message.State), entry.service, h.by)
+	if h.host && entry.held == nil {
+		g.registry.host(entry.host).Held++
+	}
+	entry.held = n
+	entry.heldBy = h
+	g.held[registryKey(entry.host, entry.service)] = entry
+}
+
+// releaseHeld - sends what is no longer held back. Entries that are buffering are left alone,
+// they will decide on their true state shortly.
+func (g *Gateway) releaseHeld() {
+	now := g.clock.Now()
+	if g.silences != nil {
+		for _, s := range g.silences.ended(now) {
+			Logger().Info.Printf("silence %s by %s ended\n", s.ID, s.Author)
+		}
+	}
+	g.updateStorms(now)
+	for key, entry := range g.held {
+		if entry.held == nil || g.registry.getEntry(key) != entry {
+			// sent or cleared since, or garbage-collected
+			delete(g.held, key)
+			continue
+		}
+		if entry.phase == phaseBuffering {
+			continue
+		}
+		// check on a copy, annotating must not change what is held
+		n := *entry.held
+		if h := g.holdFor(entry, &n, now); h != nil {
+			entry.heldBy = h
+			continue
+		}
+		delete(g.held, key)
+		released := entry.heldBy
+		entry.held, entry.heldBy = nil, nil
+		if entry.upstreamKnown && entry.upstreamState == n.Message.State {
+			continue
+		}
+		n.Reason = released.reason + ", " + n.Reason
+		g.decision(released.rule, entry, n.Message, &n)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+/**
+ * File: host.go
+ *
+ * When a host goes down, all of its services fail with it. Rather than paging once for each
+ * of them, nbad sends one host-level result and holds the service alerts (see hold.go) until
+ * the host is back up, at which point the services that are still failing are sent.
+ *
+ * Whether a host is up is decided by its liveness services (host_liveness_services), "" being
+ * the host check itself. A host is down when one of them is decided CRITICAL (any non-OK state
+ * for a host check) or has gone silent (see freshness.go). The host-level results are sent as
+ * host check results. Liveness services and the host check itself are never held for their host
+ * being down.
+ */
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	hostCheckService = ""
+
+	// host check states
+	hostUp   = stateOk
+	hostDown = stateCritical
+)
+
+// isLivenessService returns true if the service tells whether its host is up
+func (c *NbadConfig) isLivenessService(service string) bool {
+	for _, s := range c.HostLivenessServices {
+		if s == service {
+			return true
+		}
+	}
+	return false
+}
+
+// livenessCause returns why the liveness entry says its host is down, "" if it does not
+func livenessCause(entry *MessageEntry) string {
+	if entry.message == nil || entry.phase == phaseTombstoned {
+		return ""
+	}
+	name := entry.service
+	if name == hostCheckService {
+		name = "host check"
+	}
+	if entry.freshnessAlerted {
+		return name + " is silent"
+	}
+	state, known := entry.pendingState()
+	if !known || state == stateOk || (state != stateCritical && entry.service != hostCheckService) {
+		return ""
+	}
+	return fmt.Sprintf("%s is %s", name, stateName(state))
+}
+
+// hostHold returns the hold for a non-OK service alert on a host that is down, nil if the
+// host is up (or the service is the host check or one of its liveness services)
+func (g *Gateway) hostHold(entry *MessageEntry, n *Notification) *hold {
+	if n.Message.State == stateOk || entry.service == hostCheckService || Config().isLivenessService(entry.service) {
+		return nil
+	}
+	h, ok := g.registry.hosts[entry.host]
+	if !ok || !h.Down {
+		return nil
+	}
+	return &hold{by: fmt.Sprintf("host %s being down", entry.host), rule: ruleHostRecovered,
+		reason: "host recovered", host: true}
+}
+
+// updateHost - re-evaluates the host of a liveness entry after a decision about it, and sends
+// the host-level result if the host went down or came back up
+func (g *Gateway) updateHost(entry *MessageEntry, now time.Time) {
+	if entry.message == nil || !Config().isLivenessService(entry.service) {
+		return
+	}
+
+	cause, byHostCheck := "", false
+	for _, service := range Config().HostLivenessServices {
+		if e := g.registry.getEntry(registryKey(entry.host, service)); e != nil {
+			if cause = livenessCause(e); cause != "" {
+				byHostCheck = service == hostCheckService
+				break
+			}
+		}
+	}
+
+	h := g.registry.host(entry.host)
+	if down := cause != ""; down == h.Down {
+		return
+	}
+	from := &Message{Host: entry.host, Service: hostCheckService}
+	timestamp := uint32(now.Unix())
+
+	if cause != "" {
+		h.Down, h.Since, h.Cause, h.Held = true, now, cause, 0
+		Logger().Info.Printf("host %s is down (%s), holding its service alerts\n", entry.host, cause)
+		if byHostCheck {
+			// the host check's own result already told upstream
+			return
+		}
+		output := fmt.Sprintf("host is down (%s), its service alerts are held until it recovers", cause)
+		g.decision(ruleHostDown, g.registry.own(entry.host, hostCheckService), nil, &Notification{
+			Message:     newSynthesizedMessage(from, hostDown, output, timestamp),
+			Reason:      "host down",
+			Synthesized: true,
+		})
+		return
+	}
+
+	Logger().Info.Printf("host %s is up again after %v\n", entry.host, now.Sub(h.Since))
+	output := fmt.Sprintf("host is up again after %v, %d service alerts were held while it was down",
+		now.Sub(h.Since), h.Held)
+	h.Down = false
+	// only the host down nbad sent itself needs an up, a host check tells upstream itself
+	hostEntry := g.registry.getEntry(registryKey(entry.host, hostCheckService))
+	if hostEntry == nil || !hostEntry.owned {
+		return
+	}
+	if state, known := hostEntry.pendingState(); known && state != hostUp {
+		g.decision(ruleHostUp, hostEntry, nil, &Notification{
+			Message:     newSynthesizedMessage(from, hostUp, output, timestamp),
+			Reason:      "host up",
+			Synthesized: true,
+		})
+	}
+}
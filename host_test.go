@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/JohnMurray/nbad/clock"
+)
+
+func newHostTest(t *testing.T) (*Gateway, *recordingUpstream, *clock.Fake) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		HostLivenessServices: []string{hostCheckService, "ping"}})
+	g.handleMessage(&Message{Host: "web1", Service: "ping", State: stateOk})
+	g.handleMessage(&Message{Host: "web1", Service: "http", State: stateOk})
+	g.handleMessage(&Message{Host: "web1", Service: "disk", State: stateOk})
+	after(g, clk, 10*time.Second)
+	upstream.sent = nil
+	return g, upstream, clk
+}
+
+func TestHostDownCollapsesServiceAlerts(t *testing.T) {
+	g, upstream, clk := newHostTest(t)
+	g.handleMessage(&Message{Host: "web1", Service: "ping", State: stateCritical})
+	after(g, clk, time.Second)
+	g.handleMessage(&Message{Host: "web1", Service: "http", State: stateCritical})
+	g.handleMessage(&Message{Host: "web1", Service: "disk", State: stateCritical})
+	after(g, clk, 10*time.Second)
+
+	var host *Notification
+	for _, n := range upstream.sent {
+		switch n.Message.Service {
+		case hostCheckService:
+			host = n
+		case "http", "disk":
+			t.Errorf("Service alert for %s should be held while the host is down", n.Message.Service)
+		}
+	}
+	if host == nil || host.Message.State != hostDown || !strings.Contains(host.Message.Message, "ping is CRITICAL") {
+		t.Fatalf("Expected a single host down result, got %v", host)
+	}
+	if !g.registry.hosts["web1"].Down || g.registry.hosts["web1"].Held != 2 {
+		t.Errorf("Expected the host to be down with 2 alerts held, got %+v", g.registry.hosts["web1"])
+	}
+
+	// the host comes back, but the disk is still full
+	upstream.sent = nil
+	g.handleMessage(&Message{Host: "web1", Service: "ping", State: stateOk})
+	g.handleMessage(&Message{Host: "web1", Service: "http", State: stateOk})
+	after(g, clk, 10*time.Second)
+	after(g, clk, time.Second)
+
+	sent := map[string]uint16{}
+	for _, n := range upstream.sent {
+		sent[n.Message.Service] = n.Message.State
+	}
+	if state, ok := sent[hostCheckService]; !ok || state != hostUp {
+		t.Errorf("Expected the host to be sent as up again")
+	}
+	if state, ok := sent["disk"]; !ok || state != stateCritical {
+		t.Errorf("Expected the disk, still failing, to be released")
+	}
+	if _, ok := sent["http"]; ok {
+		t.Errorf("http recovered while the host was down, nothing should have been sent for it")
+	}
+}
+
+func TestHostCheckItselfIsTheHostNotification(t *testing.T) {
+	g, upstream, clk := newHostTest(t)
+	g.handleMessage(&Message{Host: "web1", Service: hostCheckService, State: stateCritical})
+	after(g, clk, time.Second)
+	g.handleMessage(&Message{Host: "web1", Service: "http", State: stateCritical})
+	after(g, clk, 10*time.Second)
+	if len(upstream.sent) != 1 || upstream.sent[0].Synthesized {
+		t.Errorf("Expected only the host check result itself to be sent, got %d notifications", len(upstream.sent))
+	}
+	if g.registry.getEntry(registryKey("web1", hostCheckService)).owned {
+		t.Errorf("The host check reported by the client should not be taken over by nbad")
+	}
+}
+
+func TestHostDownIsSentWithoutHostCheckAsLivenessService(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		HostLivenessServices: []string{"ping"}})
+	g.handleMessage(&Message{Host: "web1", Service: "ping", State: stateOk})
+	after(g, clk, 10*time.Second)
+	upstream.sent = nil
+
+	g.handleMessage(&Message{Host: "web1", Service: "ping", State: stateCritical})
+	after(g, clk, 10*time.Second)
+	g.handleMessage(&Message{Host: "web1", Service: "ping", State: stateOk})
+	after(g, clk, 10*time.Second)
+
+	var states []uint16
+	for _, n := range upstream.sent {
+		if n.Message.Service == hostCheckService {
+			states = append(states, n.Message.State)
+		}
+	}
+	if len(states) != 2 || states[0] != hostDown || states[1] != hostUp {
+		t.Errorf("Expected the host to be sent as down, then up, got %v", states)
+	}
+}
+
+func TestHostDownWithoutLivenessServicesConfigured(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10})
+	g.handleMessage(&Message{Host: "web1", Service: hostCheckService, State: stateCritical})
+	g.handleMessage(&Message{Host: "web1", Service: "http", State: stateCritical})
+	after(g, clk, 10*time.Second)
+	if len(upstream.sent) != 2 {
+		t.Errorf("Host-down suppression should be off unless configured, got %d notifications", len(upstream.sent))
+	}
+}
+
+func TestHostUpIsSentAfterLongOutage(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		HostLivenessServices: []string{"ping"}})
+	g.handleMessage(&Message{Host: "web1", Service: "ping", State: stateOk})
+	after(g, clk, 10*time.Second)
+	upstream.sent = nil
+
+	// the host stays down for longer than tombstones are kept (an hour in the tests)
+	for i := 0; i < 150; i++ {
+		g.handleMessage(&Message{Host: "web1", Service: "ping", State: stateCritical})
+		after(g, clk, 30*time.Second)
+	}
+	g.handleMessage(&Message{Host: "web1", Service: "ping", State: stateOk})
+	after(g, clk, 10*time.Second)
+
+	var states []uint16
+	for _, n := range upstream.sent {
+		if n.Message.Service == hostCheckService {
+			states = append(states, n.Message.State)
+		}
+	}
+	if len(states) != 2 || states[0] != hostDown || states[1] != hostUp {
+		t.Errorf("Expected the host to be sent as down, then up, got %v", states)
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"net"
 	"os"
+	"time"
 
+	"github.com/JohnMurray/nbad/clock"
 	"github.com/codegangsta/cli"
 )
 
@@ -16,6 +18,10 @@ const (
 
 	errBinding           = 1
 	errAccptIncomingConn = 2
+	errFreshnessManifest = 3
+	errCaptureFile       = 4
+	errGateway           = 5
+	errAPI               = 6
 )
 
 func main() {
@@ -48,6 +54,13 @@ func main() {
 
 		startServer()
 	}
+	app.Commands = []cli.Command{
+		simulateCommand(&configFile),
+		captureCommand(),
+		auditCommand(&configFile),
+		silenceCommand(&configFile),
+		rewriteCommand(&configFile),
+	}
 	app.Run(os.Args)
 }
 
@@ -67,7 +80,27 @@ func startServer() {
 	defer listener.Close()
 
 	// sping up message registry
-	messageChannel := startGateway()
+	gateway := startGateway()
+
+	// record incoming traffic if configured
+	var capture *Capture
+	if path := Config().CaptureFile; path != "" {
+		capture, err = openCapture(path, int64(Config().CaptureMaxSizeInBytes), int(Config().CaptureMaxFiles),
+			Config().CaptureRejected)
+		if err != nil {
+			Logger().Error.Println(err)
+			os.Exit(errCaptureFile)
+		}
+		defer capture.close()
+		Logger().Info.Printf("Capturing incoming traffic to '%s'\n", path)
+	}
+
+	// export states and perfdata to graphite if configured
+	exporter := newConfiguredGraphiteExporter()
+	if exporter != nil {
+		defer exporter.close()
+		Logger().Info.Printf("Exporting to carbon at '%s'\n", Config().GraphiteAddress)
+	}
 
 	// listen for incoming connections
 	for {
@@ -76,12 +109,12 @@ func startServer() {
 			Logger().Error.Println("Error accepting connection", err.Error())
 			// FIXME should we do more than just print out an error here?
 		}
-		go handleIncomingConn(conn, messageChannel)
+		go handleIncomingConn(conn, gateway, capture, exporter)
 	}
 }
 
 // handles incoming requests
-func handleIncomingConn(conn net.Conn, messageChannel chan *GatewayEvent) {
+func handleIncomingConn(conn net.Conn, gateway *Gateway, capture *Capture, exporter *GraphiteExporter) {
 	defer conn.Close()
 
 	// TODO send an initialization message (see https://github.com/Syncbak-Git/nsca/blob/master/packet.go#L163)
@@ -99,7 +132,25 @@ func handleIncomingConn(conn net.Conn, messageChannel chan *GatewayEvent) {
 	if n < 1024 {
 		buf = buf[:n]
 	}
+	var record *CaptureRecord
+	if capture != nil {
+		record = &CaptureRecord{ReceivedAt: time.Now(), Client: conn.RemoteAddr().String(), Raw: buf}
+	}
 	message, err := parseMessage(buf)
+	if err == nil && redactOutput(message, time.Now()) && record != nil {
+		// the raw packet still holds what was redacted
+		record.Raw = nil
+	}
+	if record != nil {
+		record.Accepted = err == nil
+		record.Message = message
+		if err != nil {
+			record.Error = err.Error()
+		}
+		if err := capture.record(record); err != nil {
+			Logger().Warning.Println("Failed to capture message", err.Error())
+		}
+	}
 
 	// continue down processing pipeline
 	if err != nil {
@@ -108,26 +159,85 @@ func handleIncomingConn(conn net.Conn, messageChannel chan *GatewayEvent) {
 		conn.Write([]byte("Message could not be processed."))
 	} else {
 		Logger().Trace.Printf("Processing message: %v\n", message)
-		messageChannel <- newMessageEvent(message)
+		transform(message, time.Now())
+		if exporter != nil {
+			exporter.export(message, time.Now())
+		}
+		if !gateway.enqueue(message) {
+			conn.Write([]byte("Message dropped, nbad is overloaded."))
+		}
 	}
 	conn.Close()
 }
 
-// Starts a gateway process. Returns a channel to send new messages to the gateway.
-func startGateway() chan *GatewayEvent {
+// Starts a gateway process. Returns the gateway to send new messages to.
+func startGateway() *Gateway {
 	// channel for sending new messages to the Gateway
 	gatewayChan := make(chan *GatewayEvent, Config().GatewayMessageBufferSize)
 
-	registry := &Registry{
-		cache:                  make(map[string]*MessageEntry),
-		ttlInSeconds:           Config().MessageCacheTTLInSeconds,
-		initBufferTTLInSeconds: Config().MessageInitBufferTimeSeconds,
+	registry, err := newConfiguredRegistry(clock.Real)
+	if err != nil {
+		Logger().Error.Println(err)
+		os.Exit(errFreshnessManifest)
+	}
+	gateway, err := newConfiguredGateway(registry, gatewayChan)
+	if err != nil {
+		Logger().Error.Println(err)
+		os.Exit(errGateway)
+	}
+	if address := Config().APIAddress; address != "" {
+		if err := startAPI(address, newAPIHandler(gateway.silences, clock.Real)); err != nil {
+			Logger().Error.Println("Could not start the API", err.Error())
+			os.Exit(errAPI)
+		}
+		Logger().Info.Printf("API listening at %s\n", address)
 	}
-	gateway := newGateway(registry, gatewayChan)
 
 	go gateway.run()
 
-	return gatewayChan
+	return gateway
+}
+
+// newConfiguredRegistry - creates a registry from the config, including the services listed
+// in the freshness manifest
+func newConfiguredRegistry(c clock.Clock) (*Registry, error) {
+	registry := newRegistry(
+		Config().MessageCacheTTLInSeconds,
+		Config().MessageInitBufferTimeSeconds,
+		Config().TombstoneTTLInSeconds,
+		c,
+	)
+	if manifest := Config().FreshnessManifestFile; manifest != "" {
+		expectations, err := loadFreshnessManifest(manifest)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range expectations {
+			registry.expect(e.Host, e.Service, time.Duration(e.IntervalInSeconds)*time.Second)
+		}
+		Logger().Info.Printf("Watching %d services from freshness manifest '%s'\n", len(expectations), manifest)
+	}
+	return registry, nil
+}
+
+// newConfiguredGateway - creates a gateway from the config, with the audit log and the silences
+// (from the silences file and the config file) set up
+func newConfiguredGateway(registry *Registry, incomingEventChan chan *GatewayEvent) (*Gateway, error) {
+	gateway := newGateway(registry, incomingEventChan)
+	if path := Config().AuditFile; path != "" {
+		auditLog, err := openAuditLog(path, int64(Config().AuditMaxSizeInBytes), int(Config().AuditMaxFiles))
+		if err != nil {
+			return nil, err
+		}
+		gateway.auditLog = auditLog
+		Logger().Info.Printf("Writing decision audit log to '%s'\n", path)
+	}
+	silences, err := newConfiguredSilenceStore(registry.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	gateway.silences = silences
+	return gateway, nil
 }
 
 func newMessageEvent(m *Message) *GatewayEvent {
@@ -13,6 +13,9 @@ package main
 import (
 	"encoding/binary"
 	"fmt"
+	"strings"
+
+	"github.com/JohnMurray/nbad/perfdata"
 )
 
 const (
@@ -36,6 +39,12 @@ type Message struct {
 	Service string
 	// Message is the "plugin output" of the NSCA message [optional]
 	Message string
+	// OriginalState is the state the client reported, if a policy remapped it (see transform.go)
+	OriginalState uint16
+	// Remapped is set when State is not what the client reported
+	Remapped bool
+	// Parsed is Message split into its text and perfdata, attached by the transform stage
+	Parsed *perfdata.Output
 }
 
 // ParseMessage parses byte arrays to Nagios Message v3 spec (or as close as I can get)
@@ -72,13 +81,13 @@ func parseMessage(bytes []byte) (*Message, error) {
 	}
 
 	// read hostname (64 bytes)
-	hostname := string(bytes[14:78])
+	hostname := nullTerminated(bytes[14:78])
 
 	// read service description / name (128 bytes)
-	service := string(bytes[78:206])
+	service := nullTerminated(bytes[78:206])
 
 	// read the description (512 bytes)
-	description := string(bytes[206:718])
+	description := nullTerminated(bytes[206:718])
 
 	// last two bytes are padding so we don't have to worry about them too much
 
@@ -91,6 +100,21 @@ func parseMessage(bytes []byte) (*Message, error) {
 	}, nil
 }
 
+// parsed returns the output of the message split into its text and perfdata. Messages that did
+// not go through the transform stage are parsed leniently.
+func (m *Message) parsed() *perfdata.Output {
+	if m.Parsed != nil {
+		return m.Parsed
+	}
+	parsed, _ := perfdata.Parse(m.Message, perfdata.Lenient)
+	return parsed
+}
+
+// nullTerminated reads a fixed-width, null-padded string field
+func nullTerminated(field []byte) string {
+	return strings.TrimRight(string(field), "\x00")
+}
+
 func stateName(state uint16) string {
 	switch state {
 	case stateOk:
@@ -0,0 +1,263 @@
+// Package perfdata parses Nagios plugin output into its text and performance data
+/*
+
+Following the Nagios plugin guidelines, plugin output is made of a first line of text,
+optionally followed by lines of long text, with performance data after a pipe:
+
+	DISK CRITICAL - 91% used | /=91%;80;90;0;100
+	/     91% used
+	/var  12% used | /var=12%;80;90;0;100
+	'inodes used'=12034
+
+The first line's performance data is after its pipe. In the long text, the first pipe
+starts performance data that runs until the end of the output.
+
+Each value is 'label'=value[UOM];[warn];[crit];[min];[max]. Labels with spaces are quoted
+with single quotes, a quote in a quoted label is written as two quotes. The value is "U"
+when the plugin could not determine it. warn and crit are ranges, trailing fields that are
+not set may be left out (see Range).
+
+In Strict mode, anything that doesn't follow the guidelines is an error and no performance
+data is returned. In Lenient mode, values that can't be read are skipped, units are not
+checked and decimal commas are accepted.
+
+*/
+package perfdata
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Mode is how strictly the guidelines are followed
+type Mode int
+
+const (
+	// Lenient skips what it can't read
+	Lenient Mode = iota
+	// Strict fails on anything that doesn't follow the guidelines
+	Strict
+)
+
+// Output is plugin output split into its parts
+type Output struct {
+	// Text is the first line of text
+	Text string
+	// LongText is the text of the following lines, if any
+	LongText string
+	// Perfdata is the performance data of all lines
+	Perfdata []Value
+}
+
+// Value is a single performance data value
+type Value struct {
+	Label string
+	Value float64
+	// Unknown is set when the plugin could not determine the value ("U")
+	Unknown bool
+	// UOM is the unit of measurement ("", s, ms, us, %, B, KB, MB, GB, TB or c)
+	UOM string
+	// Warn and Crit are the warning and critical ranges ("" if not set)
+	Warn string
+	Crit string
+	// Min and Max are only valid if HasMin and HasMax are set
+	Min    float64
+	HasMin bool
+	Max    float64
+	HasMax bool
+}
+
+var (
+	units = map[string]bool{"": true, "s": true, "ms": true, "us": true, "%": true,
+		"B": true, "KB": true, "MB": true, "GB": true, "TB": true, "c": true}
+
+	numberPattern = `[-+]?(?:[0-9]+(?:\.[0-9]*)?|\.[0-9]+)(?:[eE][-+]?[0-9]+)?`
+	leadingNumber = regexp.MustCompile(`^` + numberPattern)
+)
+
+// Parse splits the output into its text, long text and performance data
+func Parse(output string, mode Mode) (*Output, error) {
+	lines := strings.Split(strings.TrimRight(output, "\n"), "\n")
+	out := &Output{}
+	text, perf := cut(lines[0])
+	out.Text = text
+
+	var long []string
+	for i, line := range lines[1:] {
+		j := strings.Index(line, "|")
+		if j < 0 {
+			long = append(long, line)
+			continue
+		}
+		if before := strings.TrimRight(line[:j], " "); before != "" {
+			long = append(long, before)
+		}
+		// the rest of the output is all perfdata
+		perf = strings.Join(append([]string{perf, line[j+1:]}, lines[i+2:]...), " ")
+		break
+	}
+	out.LongText = strings.Join(long, "\n")
+
+	values, err := ParseValues(perf, mode)
+	if err != nil {
+		return out, err
+	}
+	out.Perfdata = values
+	return out, nil
+}
+
+// cut splits a line at its first pipe
+func cut(line string) (text string, perf string) {
+	i := strings.Index(line, "|")
+	if i < 0 {
+		return strings.TrimSpace(line), ""
+	}
+	return strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+}
+
+// ParseValues reads performance data
+func ParseValues(perfdata string, mode Mode) ([]Value, error) {
+	var values []Value
+	for _, field := range fields(perfdata) {
+		v, err := parseValue(field, mode)
+		if err != nil {
+			if mode == Strict {
+				return nil, fmt.Errorf("perfdata '%s': %v", field, err)
+			}
+			continue
+		}
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func parseValue(field string, mode Mode) (Value, error) {
+	var v Value
+	label, rest, err := splitLabel(field)
+	if err != nil {
+		return v, err
+	}
+	v.Label = label
+
+	parts := strings.Split(rest, ";")
+	if len(parts) > 5 {
+		if mode == Strict {
+			return v, fmt.Errorf("too many fields")
+		}
+		parts = parts[:5]
+	}
+	for len(parts) < 5 {
+		parts = append(parts, "")
+	}
+	if mode == Lenient {
+		for i := range parts {
+			parts[i] = strings.Replace(parts[i], ",", ".", -1)
+		}
+	}
+
+	if parts[0] == "U" {
+		v.Unknown = true
+	} else {
+		number := leadingNumber.FindString(parts[0])
+		if number == "" {
+			return v, fmt.Errorf("invalid value '%s'", parts[0])
+		}
+		v.Value, _ = strconv.ParseFloat(number, 64)
+		v.UOM = parts[0][len(number):]
+		if mode == Strict && !units[v.UOM] {
+			return v, fmt.Errorf("unknown unit '%s'", v.UOM)
+		}
+	}
+
+	v.Warn, v.Crit = parts[1], parts[2]
+	for _, r := range []string{v.Warn, v.Crit} {
+		if r == "" {
+			continue
+		}
+		if _, err := ParseRange(r); err != nil && mode == Strict {
+			return v, err
+		}
+	}
+
+	if v.Min, v.HasMin, err = parseLimit(parts[3]); err != nil && mode == Strict {
+		return v, err
+	}
+	if v.Max, v.HasMax, err = parseLimit(parts[4]); err != nil && mode == Strict {
+		return v, err
+	}
+	return v, nil
+}
+
+// splitLabel splits a field into its (unquoted) label and what comes after the '='
+func splitLabel(field string) (label string, rest string, err error) {
+	if strings.HasPrefix(field, "'") {
+		// quoted, '' is a quote
+		for i := 1; i < len(field); i++ {
+			if field[i] != '\'' {
+				continue
+			}
+			if i+1 < len(field) && field[i+1] == '\'' {
+				i++
+				continue
+			}
+			if i+1 >= len(field) || field[i+1] != '=' {
+				return "", "", fmt.Errorf("expected '=' after the label")
+			}
+			label = strings.Replace(field[1:i], "''", "'", -1)
+			rest = field[i+2:]
+			break
+		}
+		if rest == "" && label == "" {
+			return "", "", fmt.Errorf("unterminated label")
+		}
+	} else {
+		i := strings.Index(field, "=")
+		if i < 0 {
+			return "", "", fmt.Errorf("expected label=value")
+		}
+		label, rest = field[:i], field[i+1:]
+	}
+	if label == "" {
+		return "", "", fmt.Errorf("empty label")
+	}
+	return label, rest, nil
+}
+
+// parseLimit reads a min or max, which may be left empty
+func parseLimit(s string) (float64, bool, error) {
+	if s == "" {
+		return 0, false, nil
+	}
+	if !leadingNumber.MatchString(s) || leadingNumber.FindString(s) != s {
+		return 0, false, fmt.Errorf("invalid min/max '%s'", s)
+	}
+	f, _ := strconv.ParseFloat(s, 64)
+	return f, true, nil
+}
+
+// fields splits the performance data on whitespace outside of quoted labels
+func fields(perfdata string) []string {
+	var result []string
+	var field []rune
+	quoted := false
+	for _, r := range perfdata {
+		switch {
+		case r == '\'':
+			quoted = !quoted
+			field = append(field, r)
+		case !quoted && (r == ' ' || r == '\t' || r == '\n' || r == '\r'):
+			if len(field) > 0 {
+				result = append(result, string(field))
+				field = field[:0]
+			}
+		default:
+			field = append(field, r)
+		}
+	}
+	if len(field) > 0 {
+		result = append(result, string(field))
+	}
+	return result
+}
@@ -0,0 +1,87 @@
+package perfdata
+
+import (
+	"testing"
+)
+
+func TestParseOutput(t *testing.T) {
+	out, err := Parse("DISK CRITICAL - 91% used | /=91%;80;90;0;100\n"+
+		"/     91% used\n"+
+		"/var  12% used | /var=12%;80;90;0;100\n"+
+		"'inodes used'=12034\n", Strict)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out.Text != "DISK CRITICAL - 91% used" {
+		t.Errorf("Unexpected text '%s'", out.Text)
+	}
+	if out.LongText != "/     91% used\n/var  12% used" {
+		t.Errorf("Unexpected long text '%s'", out.LongText)
+	}
+	if len(out.Perfdata) != 3 || out.Perfdata[0].Label != "/" || out.Perfdata[1].Label != "/var" ||
+		out.Perfdata[2].Label != "inodes used" {
+		t.Errorf("Expected the perfdata of all lines, got %v", out.Perfdata)
+	}
+
+	out, _ = Parse("PING OK", Strict)
+	if out.Text != "PING OK" || out.LongText != "" || out.Perfdata != nil {
+		t.Errorf("Unexpected output without perfdata %+v", out)
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	var tests = []struct {
+		perfdata string
+		expected Value
+	}{
+		{"/=91%;80;90;0;100", Value{Label: "/", Value: 91, UOM: "%", Warn: "80", Crit: "90",
+			Min: 0, HasMin: true, Max: 100, HasMax: true}},
+		{"time=0.25s;;;0", Value{Label: "time", Value: 0.25, UOM: "s", HasMin: true}},
+		{"'inodes used'=12034", Value{Label: "inodes used", Value: 12034}},
+		{"'it''s'=1c", Value{Label: "it's", Value: 1, UOM: "c"}},
+		{"rta=-1.5ms;@10:20;~:30", Value{Label: "rta", Value: -1.5, UOM: "ms", Warn: "@10:20", Crit: "~:30"}},
+		{"load=U;5;10", Value{Label: "load", Unknown: true, Warn: "5", Crit: "10"}},
+		{"big=1e3B", Value{Label: "big", Value: 1000, UOM: "B"}},
+	}
+	for i, tt := range tests {
+		values, err := ParseValues(tt.perfdata, Strict)
+		if err != nil {
+			t.Errorf("failed test %d: %v", i, err)
+			continue
+		}
+		if len(values) != 1 || values[0] != tt.expected {
+			t.Errorf("failed test %d: got %+v, wanted %+v", i, values, tt.expected)
+		}
+	}
+}
+
+func TestStrictAndLenient(t *testing.T) {
+	var tests = []struct {
+		perfdata string
+		lenient  int
+	}{
+		{"a=1 junk b=2", 2},
+		{"a=1,5 b=2", 2},
+		{"a=1apples", 1},
+		{"a=1;;;;;", 1},
+		{"a=1;5:x", 1},
+		{"a=1;;;zero", 1},
+		{"=1 b=2", 1},
+		{"'a b=1 c=2", 0},
+		{"a=fast", 0},
+	}
+	for i, tt := range tests {
+		if _, err := ParseValues(tt.perfdata, Strict); err == nil {
+			t.Errorf("failed test %d: expected '%s' to be rejected in strict mode", i, tt.perfdata)
+		}
+		values, err := ParseValues(tt.perfdata, Lenient)
+		if err != nil || len(values) != tt.lenient {
+			t.Errorf("failed test %d: expected %d values in lenient mode, got %v (%v)", i, tt.lenient, values, err)
+		}
+	}
+
+	values, _ := ParseValues("a=1,5", Lenient)
+	if values[0].Value != 1.5 {
+		t.Errorf("Expected a decimal comma in lenient mode, got %v", values[0].Value)
+	}
+}
@@ -0,0 +1,69 @@
+package perfdata
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Range is a warning or critical threshold in the syntax of the Nagios plugin guidelines:
+//
+//	10      alert if < 0 or > 10
+//	10:     alert if < 10
+//	~:10    alert if > 10
+//	10:20   alert if < 10 or > 20
+//	@10:20  alert if >= 10 and <= 20
+type Range struct {
+	Start  float64
+	End    float64
+	Inside bool
+	text   string
+}
+
+// ParseRange reads a range
+func ParseRange(s string) (*Range, error) {
+	r := &Range{text: s, End: math.Inf(1)}
+	if strings.HasPrefix(s, "@") {
+		r.Inside = true
+		s = s[1:]
+	}
+	if s == "" {
+		return nil, fmt.Errorf("empty range '%s'", r.text)
+	}
+
+	start, end := "", s
+	if i := strings.Index(s, ":"); i >= 0 {
+		start, end = s[:i], s[i+1:]
+	}
+	var err error
+	switch start {
+	case "":
+	case "~":
+		r.Start = math.Inf(-1)
+	default:
+		if r.Start, err = strconv.ParseFloat(start, 64); err != nil {
+			return nil, fmt.Errorf("invalid range '%s'", r.text)
+		}
+	}
+	if end != "" {
+		if r.End, err = strconv.ParseFloat(end, 64); err != nil {
+			return nil, fmt.Errorf("invalid range '%s'", r.text)
+		}
+	}
+	if r.Start > r.End {
+		return nil, fmt.Errorf("invalid range '%s': start is greater than end", r.text)
+	}
+	return r, nil
+}
+
+// Alert returns true if the value is outside the range (or inside, for ranges starting with @)
+func (r *Range) Alert(v float64) bool {
+	inside := v >= r.Start && v <= r.End
+	return inside == r.Inside
+}
+
+// String returns the range as it was written
+func (r *Range) String() string {
+	return r.text
+}
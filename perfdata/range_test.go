@@ -0,0 +1,49 @@
+package perfdata
+
+import (
+	"testing"
+)
+
+func TestRangeAlert(t *testing.T) {
+	var tests = []struct {
+		r     string
+		value float64
+		alert bool
+	}{
+		{"10", 5, false},
+		{"10", 10, false},
+		{"10", 11, true},
+		{"10", -1, true},
+		{"10:", 10, false},
+		{"10:", 9.9, true},
+		{"~:10", -1000, false},
+		{"~:10", 10.5, true},
+		{"10:20", 15, false},
+		{"10:20", 21, true},
+		{"10:20", 9, true},
+		{"@10:20", 10, true},
+		{"@10:20", 20, true},
+		{"@10:20", 21, false},
+		{"@~:5", -3, true},
+		{"@5", 6, false},
+		{"-1.5:1e2", 50, false},
+	}
+	for i, tt := range tests {
+		r, err := ParseRange(tt.r)
+		if err != nil {
+			t.Errorf("failed test %d: %v", i, err)
+			continue
+		}
+		if r.Alert(tt.value) != tt.alert {
+			t.Errorf("failed test %d: expected '%s' to alert=%v on %v", i, tt.r, tt.alert, tt.value)
+		}
+	}
+}
+
+func TestInvalidRanges(t *testing.T) {
+	for _, s := range []string{"", "@", "abc", "20:10", "1:2:3", "~", "10:x"} {
+		if _, err := ParseRange(s); err == nil {
+			t.Errorf("Expected range '%s' to be rejected", s)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+/**
+ * File: policy.go
+ *
+ * Policies allow the default behavior defined in the config file to be overridden for
+ * specific hosts and services. Policies are checked in the order they are defined in the
+ * config file and the first one that matches is used. Services that do not match any
+ * policy use the defaults.
+ *
+ * A policy matches on the host and the service, each either with a glob pattern or with
+ * a regular expression (which has to match the whole name). In globs '*' matches any number
+ * of characters, '/' and spaces included (service names like "Disk /var" are common), '?'
+ * matches a single character and '[...]' a character class. Anything left out matches
+ * everything. A policy can also be limited to a time period (see the timeperiod package),
+ * outside of which it is skipped as if it did not match.
+ *
+ * The policies matching a service are looked up once per registry entry, when the service is
+ * first seen, so the matching is not repeated for every message. Only their time periods are
+ * checked whenever the gateway makes a decision.
+ */
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/JohnMurray/nbad/timeperiod"
+)
+
+// Policy overrides default behavior for the hosts and services it matches
+type Policy struct {
+	// Host - glob pattern matched against the host name
+	Host string `json:"host"`
+
+	// HostRegex - regular expression matched against the host name
+	HostRegex string `json:"host_regex"`
+
+	// Service - glob pattern matched against the service name
+	Service string `json:"service"`
+
+	// ServiceRegex - regular expression matched against the service name
+	ServiceRegex string `json:"service_regex"`
+
+	// TimePeriod - name of the time period the policy applies in (always if empty)
+	TimePeriod string `json:"timeperiod"`
+
+	// MessageCacheTTLInSeconds - overrides the time before a message expires
+	MessageCacheTTLInSeconds *uint `json:"message_cache_ttl_in_seconds"`
+
+	// MessageInitBufferTimeSeconds - overrides the amount of time a message is buffered
+	MessageInitBufferTimeSeconds *uint `json:"message_init_buffer_ttl_in_seconds"`
+
+	// FlapCountThreshold - overrides the number of state changes before a service is flapping
+	FlapCountThreshold *uint `json:"flap_count_threshold"`
+
+	// ExpiryAction - overrides the default expiry action
+	ExpiryAction string `json:"expiry_action"`
+
+	// ExpiryOutput - overrides the default expiry output template
+	ExpiryOutput string `json:"expiry_output"`
+
+	// BufferAggregation - overrides how results seen during the init buffer are aggregated
+	BufferAggregation string `json:"buffer_aggregation"`
+
+	// DedupNormalize - overrides the parts of the output masked before outputs are compared
+	DedupNormalize []string `json:"dedup_normalize"`
+
+	// ForwardOnOutputChange - overrides whether same-state results are forwarded when their output changed
+	ForwardOnOutputChange *bool `json:"forward_on_output_change"`
+
+	// PerfdataChangePercent - overrides how far a perfdata value has to move for a same-state result to be forwarded
+	PerfdataChangePercent *uint `json:"perfdata_change_percent"`
+
+	// RecoveryHoldInSeconds - overrides how long a recovery is held before it is sent (0 disables)
+	RecoveryHoldInSeconds *uint `json:"recovery_hold_in_seconds"`
+
+	// FreshnessThresholdInSeconds - overrides the default expected reporting interval (0 disables)
+	FreshnessThresholdInSeconds *uint `json:"freshness_threshold_in_seconds"`
+
+	// Upstream - name of the upstream route results are sent through
+	Upstream string `json:"upstream"`
+
+	// Digest - name of the digest results are collected by instead of being sent, see digest.go
+	Digest string `json:"digest"`
+
+	// StateMap - rules remapping the state of results, the first matching rule applies (see transform.go)
+	StateMap []*StateRule `json:"state_map"`
+
+	// ShowOriginalState - note the state the client reported in the output of remapped results
+	ShowOriginalState bool `json:"show_original_state"`
+
+	// Thresholds - perfdata thresholds the state of results is recomputed from (see threshold.go)
+	Thresholds []*Threshold `json:"thresholds"`
+
+	// Rewrite - rules changing the output of results, applied in order (see rewrite.go)
+	Rewrite []*RewriteRule `json:"rewrite"`
+
+	expiry       *ExpiryPolicy
+	dedup        *DedupPolicy
+	hostRegex    *regexp.Regexp
+	serviceRegex *regexp.Regexp
+	period       *timeperiod.Period
+	digest       *Digest
+}
+
+// matches returns true if the policy applies to the host and service
+func (p *Policy) matches(host string, service string) bool {
+	return matchName(host, p.hostRegex) && matchName(service, p.serviceRegex)
+}
+
+// activeAt returns true if the policy applies at the given time
+func (p *Policy) activeAt(now time.Time) bool {
+	return p.period == nil || p.period.Contains(now)
+}
+
+// matchName returns true if the name matches the compiled glob or regex (see compileMatcher),
+// a nil one matches every name
+func matchName(name string, re *regexp.Regexp) bool {
+	return re == nil || re.MatchString(name)
+}
+
+// String describes what the policy matches, for log and error messages
+func (p *Policy) String() string {
+	var parts []string
+	for _, m := range []struct{ name, glob, regex string }{
+		{"host", p.Host, p.HostRegex},
+		{"service", p.Service, p.ServiceRegex},
+	} {
+		if m.regex != "" {
+			parts = append(parts, fmt.Sprintf("%s =~ /%s/", m.name, m.regex))
+		} else if m.glob != "" {
+			parts = append(parts, fmt.Sprintf("%s '%s'", m.name, m.glob))
+		}
+	}
+	if p.TimePeriod != "" {
+		parts = append(parts, fmt.Sprintf("during '%s'", p.TimePeriod))
+	}
+	if len(parts) == 0 {
+		return "policy matching everything"
+	}
+	return "policy for " + strings.Join(parts, ", ")
+}
+
+// compileMatcher compiles a glob or regex pair (only one of them may be set) into a regex
+// matching whole names, nil if neither is set
+func compileMatcher(name string, glob string, expr string) (*regexp.Regexp, error) {
+	if glob != "" && expr != "" {
+		return nil, fmt.Errorf("only one of %s and %s_regex can be set", name, name)
+	}
+	if expr != "" {
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s regex '%s': %v", name, expr, err)
+		}
+		return re, nil
+	}
+	if glob == "" {
+		return nil, nil
+	}
+	re, err := globRegexp(glob)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s pattern '%s': %v", name, glob, err)
+	}
+	return re, nil
+}
+
+// globRegexp translates a glob into a regex matching whole names. Unlike path.Match, '*' also
+// matches '/'.
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	expr := "^"
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			expr += ".*"
+		case '?':
+			expr += "."
+		case '\\':
+			if i++; i == len(glob) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			expr += regexp.QuoteMeta(glob[i : i+1])
+		case '[':
+			end := strings.Index(glob[i+1:], "]")
+			if end == 0 {
+				// a ']' right after the '[' is part of the class
+				end = strings.Index(glob[i+2:], "]") + 1
+			}
+			if end <= 0 {
+				return nil, fmt.Errorf("unterminated character class")
+			}
+			class := glob[i+1 : i+1+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr += "[" + class + "]"
+			i += end + 1
+		default:
+			expr += regexp.QuoteMeta(glob[i : i+1])
+		}
+	}
+	return regexp.Compile(expr + "$")
+}
+
+// compile validates the policy and fills in anything not overridden from the config defaults
+func (p *Policy) compile(c *NbadConfig) error {
+	var err error
+	if p.hostRegex, err = compileMatcher("host", p.Host, p.HostRegex); err != nil {
+		return err
+	}
+	if p.serviceRegex, err = compileMatcher("service", p.Service, p.ServiceRegex); err != nil {
+		return err
+	}
+	if p.TimePeriod != "" {
+		if p.period = c.timePeriods[p.TimePeriod]; p.period == nil {
+			return fmt.Errorf("%s: unknown time period '%s'", p, p.TimePeriod)
+		}
+	}
+
+	for _, r := range p.StateMap {
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+	}
+	for _, r := range p.Rewrite {
+		if err := r.compile(); err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+	}
+	for _, t := range p.Thresholds {
+		if err := t.compile(); err != nil {
+			return fmt.Errorf("%s: %v", p, err)
+		}
+	}
+
+	if p.Digest != "" {
+		if p.digest = c.digests[p.Digest]; p.digest == nil {
+			return fmt.Errorf("%s: unknown digest '%s'", p, p.Digest)
+		}
+	}
+
+	if p.MessageCacheTTLInSeconds != nil || p.MessageInitBufferTimeSeconds != nil {
+		ttl, buffer := c.MessageCacheTTLInSeconds, c.MessageInitBufferTimeSeconds
+		if p.MessageCacheTTLInSeconds != nil {
+			ttl = *p.MessageCacheTTLInSeconds
+		}
+		if p.MessageInitBufferTimeSeconds != nil {
+			buffer = *p.MessageInitBufferTimeSeconds
+		}
+		if buffer > ttl {
+			return fmt.Errorf("%s: init buffer ttl cannot be greater than message cache ttl", p)
+		}
+	}
+
+	action, output := p.ExpiryAction, p.ExpiryOutput
+	if action == "" {
+		action = c.ExpiryAction
+	}
+	if output == "" {
+		output = c.ExpiryOutput
+	}
+	expiry, err := newExpiryPolicy(action, output)
+	if err != nil {
+		return fmt.Errorf("%s: %v", p, err)
+	}
+	p.expiry = expiry
+
+	normalize, onOutputChange, perfdataChange := p.DedupNormalize, c.ForwardOnOutputChange, c.PerfdataChangePercent
+	if normalize == nil {
+		normalize = c.DedupNormalize
+	}
+	if p.ForwardOnOutputChange != nil {
+		onOutputChange = *p.ForwardOnOutputChange
+	}
+	if p.PerfdataChangePercent != nil {
+		perfdataChange = *p.PerfdataChangePercent
+	}
+	if p.dedup, err = newDedupPolicy(normalize, onOutputChange, perfdataChange); err != nil {
+		return fmt.Errorf("%s: %v", p, err)
+	}
+
+	if p.BufferAggregation == "" {
+		p.BufferAggregation = c.BufferAggregation
+	}
+	if !validAggregation(p.BufferAggregation) {
+		return fmt.Errorf("%s: unknown buffer aggregation '%s'", p, p.BufferAggregation)
+	}
+
+	return nil
+}
+
+// policiesFor returns the policies matching the host and service, in order
+func (c *NbadConfig) policiesFor(host string, service string) []*Policy {
+	var policies []*Policy
+	for _, p := range c.Policies {
+		if p.matches(host, service) {
+			policies = append(policies, p)
+		}
+	}
+	return policies
+}
+
+// policyFor returns the first policy matching the host and service at the given time, or nil
+// if none match
+func (c *NbadConfig) policyFor(host string, service string, now time.Time) *Policy {
+	return firstActivePolicy(c.policiesFor(host, service), now)
+}
+
+func firstActivePolicy(policies []*Policy, now time.Time) *Policy {
+	for _, p := range policies {
+		if p.activeAt(now) {
+			return p
+		}
+	}
+	return nil
+}
+
+// flapThresholdFor returns the flap count threshold under the policy (nil for the defaults)
+func (c *NbadConfig) flapThresholdFor(p *Policy) uint {
+	if p != nil && p.FlapCountThreshold != nil {
+		return *p.FlapCountThreshold
+	}
+	return c.FlapCountThreshold
+}
+
+// expiryPolicyFor returns the expiry policy under the policy (nil for the defaults)
+func (c *NbadConfig) expiryPolicyFor(p *Policy) *ExpiryPolicy {
+	if p != nil {
+		return p.expiry
+	}
+	return c.expiry
+}
+
+// upstreamFor returns the upstream route under the policy (nil for the defaults)
+func (c *NbadConfig) upstreamFor(p *Policy) string {
+	if p != nil {
+		return p.Upstream
+	}
+	return ""
+}
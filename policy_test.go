@@ -0,0 +1,184 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JohnMurray/nbad/timeperiod"
+)
+
+func TestPolicyMatching(t *testing.T) {
+	useTestConfig(t, &NbadConfig{Policies: []*Policy{
+		{Host: "db*", Service: "disk_*"},
+		{HostRegex: `web[0-9]+`, ServiceRegex: `http|https`},
+		{Service: "disk_*"},
+	}})
+	tests := []struct {
+		host, service string
+		policy        int
+	}{
+		{"db1", "disk_root", 0},
+		{"web1", "disk_root", 2},
+		{"web12", "https", 1},
+		{"web12", "https_cert", -1},
+		{"xweb12", "http", -1},
+		{"db1", "load", -1},
+	}
+	for _, tt := range tests {
+		p := Config().policyFor(tt.host, tt.service, time.Now())
+		if tt.policy < 0 {
+			if p != nil {
+				t.Errorf("%s/%s: expected no policy, got %s", tt.host, tt.service, p)
+			}
+		} else if p != Config().Policies[tt.policy] {
+			t.Errorf("%s/%s: expected policy %d, got %v", tt.host, tt.service, tt.policy, p)
+		}
+	}
+}
+
+func TestGlobsMatchAnyCharacter(t *testing.T) {
+	tests := []struct {
+		glob, name string
+		match      bool
+	}{
+		{"*", "Disk /var", true},
+		{"Disk*", "Disk /var", true},
+		{"HTTP /health", "HTTP /health", true},
+		{"HTTP /*", "HTTP /health/live", true},
+		{"HTTP /*", "HTTPS /health", false},
+		{"disk_?", "disk_a", true},
+		{"disk_?", "disk_ab", false},
+		{"web[0-9]", "web1", true},
+		{"web[!0-9]", "web1", false},
+		{"a.b", "axb", false},
+		{`\*`, "*", true},
+		{`\*`, "x", false},
+	}
+	for _, tt := range tests {
+		re, err := compileMatcher("service", tt.glob, "")
+		if err != nil {
+			t.Fatalf("%s: %v", tt.glob, err)
+		}
+		if matchName(tt.name, re) != tt.match {
+			t.Errorf("Expected '%s' matching '%s' to be %v", tt.glob, tt.name, tt.match)
+		}
+	}
+	for _, glob := range []string{"web[0-9", `disk\`} {
+		if _, err := compileMatcher("service", glob, ""); err == nil {
+			t.Errorf("Expected '%s' to be rejected", glob)
+		}
+	}
+}
+
+func TestPolicyCompileErrors(t *testing.T) {
+	tests := []*Policy{
+		{Host: "db*", HostRegex: "db.*"},
+		{ServiceRegex: "("},
+		{MessageInitBufferTimeSeconds: uintPtr(120)},
+		{BufferAggregation: "median"},
+	}
+	for _, p := range tests {
+		c := &NbadConfig{MessageCacheTTLInSeconds: 60, Policies: []*Policy{p}}
+		if err := c.compile(); err == nil {
+			t.Errorf("Expected %s to be rejected", p)
+		}
+	}
+}
+
+func TestPolicyOverridesResolvedPerEntry(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		Policies: []*Policy{{Host: "fast", MessageCacheTTLInSeconds: uintPtr(20),
+			MessageInitBufferTimeSeconds: uintPtr(2), Upstream: "pager"}}})
+	g.handleMessage(&Message{Host: "fast", Service: "s", State: stateCritical})
+	g.handleMessage(&Message{Host: "slow", Service: "s", State: stateCritical})
+
+	after(g, clk, 2*time.Second)
+	if len(upstream.sent) != 1 || upstream.sent[0].Message.Host != "fast" {
+		t.Fatalf("Expected only the host with the shorter buffer to be sent, got %d notifications", len(upstream.sent))
+	}
+	if upstream.sent[0].Route != "pager" {
+		t.Errorf("Expected the policy's upstream route, got '%s'", upstream.sent[0].Route)
+	}
+
+	after(g, clk, 8*time.Second)
+	if len(upstream.sent) != 2 || upstream.sent[1].Route != "" {
+		t.Fatalf("Expected the other host on the default route, got %d notifications", len(upstream.sent))
+	}
+
+	// the shorter ttl expires the first host well before the registry default of 60s
+	after(g, clk, 12*time.Second)
+	if len(upstream.sent) != 3 || upstream.sent[2].Message.Host != "fast" || upstream.sent[2].Message.State != stateOk {
+		t.Errorf("Expected the host with the shorter ttl to expire to OK, got %d notifications", len(upstream.sent))
+	}
+}
+
+func TestPolicyOverridesFlapThreshold(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 100, MessageInitBufferTimeSeconds: 10,
+		Policies: []*Policy{{Service: "flaky", FlapCountThreshold: uintPtr(2)}}})
+	for i := 0; i < 4; i++ {
+		state := uint16(stateOk)
+		if i%2 == 0 {
+			state = stateCritical
+		}
+		g.handleMessage(&Message{Host: "h", Service: "flaky", State: state})
+		g.handleMessage(&Message{Host: "h", Service: "steady", State: state})
+		after(g, clk, time.Second)
+	}
+	flaps := 0
+	for _, n := range upstream.sent {
+		if n.Reason == "flapping" {
+			flaps++
+			if n.Message.Service != "flaky" {
+				t.Errorf("Only the service with the lower threshold should flap, got %s", n.Message.Service)
+			}
+		}
+	}
+	if flaps == 0 {
+		t.Errorf("Expected the service with the lower threshold to flap")
+	}
+}
+
+func TestPolicyOnlyAppliesDuringItsTimePeriod(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		MessageCacheTTLInSeconds: 60, TimePeriods: map[string]*timeperiod.Definition{
+			"business-hours": {Ranges: map[string]string{"monday-friday": "09:00-17:00"}},
+		},
+		Policies: []*Policy{{Service: "checkout", TimePeriod: "business-hours", MessageInitBufferTimeSeconds: uintPtr(1)}}})
+
+	// Thursday night, the default buffer applies
+	g.handleMessage(&Message{Host: "h", Service: "checkout", State: stateCritical})
+	after(g, clk, time.Second)
+	if len(upstream.sent) != 0 {
+		t.Fatalf("The policy should not apply outside business hours")
+	}
+	after(g, clk, 9*time.Second)
+
+	// Thursday 10:00
+	clk.Set(time.Date(1970, 1, 1, 10, 0, 0, 0, time.UTC))
+	g.expireOldMessages()
+	sent := len(upstream.sent)
+	g.handleMessage(&Message{Host: "h", Service: "checkout", State: stateWarning})
+	after(g, clk, time.Second)
+	if len(upstream.sent) != sent+1 || upstream.sent[sent].Message.State != stateWarning {
+		t.Errorf("Expected the shorter buffer during business hours")
+	}
+}
+
+func TestPolicyWithUnknownTimePeriodIsRejected(t *testing.T) {
+	c := &NbadConfig{Policies: []*Policy{{Service: "s", TimePeriod: "never-defined"}}}
+	if err := c.compile(); err == nil {
+		t.Errorf("Expected an unknown time period to be rejected")
+	}
+}
+
+func TestPolicyWithoutInitBuffer(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		Policies: []*Policy{{Service: "instant", MessageInitBufferTimeSeconds: uintPtr(0)}}})
+	for _, state := range []uint16{stateOk, stateCritical, stateOk} {
+		g.handleMessage(&Message{Host: "h", Service: "instant", State: state})
+		after(g, clk, time.Second)
+	}
+	if len(upstream.sent) != 3 {
+		t.Errorf("Expected every state change to be sent straight away, got %d notifications", len(upstream.sent))
+	}
+}
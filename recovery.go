@@ -0,0 +1,30 @@
+package main
+
+/**
+ * File: recovery.go
+ *
+ * A service that recovers for a few seconds before failing again makes for the noisiest alerts.
+ * With a recovery hold, an OK following a non-OK state is not sent upstream when the init buffer
+ * ends. Instead the service keeps buffering for the hold duration, and the OK is only sent if no
+ * non-OK state was reported in that time. A non-OK state during the hold restarts the init buffer
+ * as usual (and counts towards flapping), so upstream never sees the short recovery.
+ */
+
+import (
+	"time"
+)
+
+// recoveryHoldFor returns how long a recovery is held under the policy (nil for the defaults),
+// 0 if it isn't
+func (c *NbadConfig) recoveryHoldFor(p *Policy) time.Duration {
+	hold := c.RecoveryHoldInSeconds
+	if p != nil && p.RecoveryHoldInSeconds != nil {
+		hold = *p.RecoveryHoldInSeconds
+	}
+	return time.Duration(hold) * time.Second
+}
+
+// isRecovery is true when sending the message would clear a non-OK state upstream
+func isRecovery(entry *MessageEntry, message *Message) bool {
+	return message.State == stateOk && entry.upstreamKnown && entry.upstreamState != stateOk
+}
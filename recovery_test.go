@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JohnMurray/nbad/clock"
+)
+
+func uintPtr(v uint) *uint {
+	return &v
+}
+
+func newRecoveryTest(t *testing.T) (*Gateway, *recordingUpstream, *clock.Fake) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		MessageCacheTTLInSeconds: 600, RecoveryHoldInSeconds: 30})
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateCritical})
+	after(g, clk, 10*time.Second)
+	if len(upstream.sent) != 1 {
+		t.Fatalf("Expected the CRITICAL upstream, got %d notifications", len(upstream.sent))
+	}
+	return g, upstream, clk
+}
+
+func TestRecoveryIsHeld(t *testing.T) {
+	g, upstream, clk := newRecoveryTest(t)
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateOk})
+	after(g, clk, 10*time.Second)
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateOk})
+	after(g, clk, 29*time.Second)
+	if len(upstream.sent) != 1 {
+		t.Fatalf("The recovery should be held, got %d notifications", len(upstream.sent))
+	}
+	after(g, clk, time.Second)
+	if len(upstream.sent) != 2 || upstream.sent[1].Message.State != stateOk {
+		t.Errorf("Expected the OK once the hold is over, got %d notifications", len(upstream.sent))
+	}
+}
+
+func TestTransientRecoveryIsNotSent(t *testing.T) {
+	g, upstream, clk := newRecoveryTest(t)
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateOk})
+	after(g, clk, 10*time.Second)
+	after(g, clk, 20*time.Second)
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateCritical})
+	after(g, clk, 30*time.Second)
+	if len(upstream.sent) != 1 {
+		t.Errorf("A transient recovery should never reach upstream, got %d notifications", len(upstream.sent))
+	}
+}
+
+func TestRecoveryHoldOnlyAppliesToRecoveries(t *testing.T) {
+	g, upstream, clk := newRecoveryTest(t)
+	g.handleMessage(&Message{Host: "h", Service: "s", State: stateWarning})
+	after(g, clk, 10*time.Second)
+	if len(upstream.sent) != 2 || upstream.sent[1].Message.State != stateWarning {
+		t.Errorf("A change to WARNING should not be held, got %d notifications", len(upstream.sent))
+	}
+}
+
+func TestPolicyOverridesRecoveryHold(t *testing.T) {
+	useTestConfig(t, &NbadConfig{RecoveryHoldInSeconds: 30,
+		Policies: []*Policy{{Service: "web", RecoveryHoldInSeconds: uintPtr(0)}}})
+	if hold := Config().recoveryHoldFor(Config().policyFor("h", "web", time.Now())); hold != 0 {
+		t.Errorf("Expected the policy to disable the hold, got %v", hold)
+	}
+	if hold := Config().recoveryHoldFor(Config().policyFor("h", "db", time.Now())); hold != 30*time.Second {
+		t.Errorf("Expected the default hold, got %v", hold)
+	}
+}
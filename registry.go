@@ -7,75 +7,438 @@ package main
  * through the agent. What exists in the registry for any given event can be thought
  * of the last known state of the message / event. This local cache aids in decision
  * making of what should be sent up to the master Nagios host.
+ *
+ * Every entry moves through a small lifecycle:
+ *
+ *              message                     init-buffer expires
+ *    (none) -----------> buffering --------------------------------> decided
+ *                          ^   ^                                        |
+ *                          |   |    message with a different state     |
+ *                          |   +----------------------------------------+
+ *                          |                                            | ttl expires
+ *                          |          message                           v
+ *                          +----------------------------------------- expired
+ *                          |                                            |
+ *                          |          message                           | (unless sticky)
+ *                          +----------------------------------------- tombstoned
+ *                                                                       |
+ *                                                                       | tombstone ttl
+ *                                                                       v
+ *                                                                    (removed)
+ *
+ * With a recovery hold (see recovery.go) the init buffer of a recovering service is extended
+ * once before the entry is decided.
+ *
+ * Each transition is made through one of the methods below, which refuse to make a
+ * transition that is not valid from the entry's current phase. That is what guarantees
+ * that the gateway acts on every buffer/ttl expiry exactly once. Tombstones only remember
+ * what state the upstream has for the service, so that a service coming back in the same
+ * state does not get re-sent.
+ *
+ * The registry also keeps a timer heap with the next deadline of every entry (see
+ * 'MessageEntry.nextDeadline'), updated by the transitions, so the gateway only ever looks
+ * at the entries that are due rather than scanning the whole registry.
  */
 
 import (
 	"fmt"
 	"time"
 
+	"github.com/JohnMurray/nbad/clock"
 	"github.com/JohnMurray/nbad/flapper"
+	"github.com/JohnMurray/nbad/timerheap"
+)
+
+// entryPhase is where an entry is in its lifecycle
+type entryPhase int
+
+const (
+	phaseBuffering entryPhase = iota
+	phaseDecided
+	phaseExpired
+	phaseTombstoned
 )
 
+func (p entryPhase) String() string {
+	switch p {
+	case phaseBuffering:
+		return "buffering"
+	case phaseDecided:
+		return "decided"
+	case phaseExpired:
+		return "expired"
+	default:
+		return "tombstoned"
+	}
+}
+
 // Registry is just a fancy cache with a TTL
 type Registry struct {
-	// cache of messages
+	// cache of messages (keyed by registryKey)
 	cache map[string]*MessageEntry
 
+	// state of the hosts with liveness services (see host.go)
+	hosts map[string]*HostState
+
 	// how long before a message should be expired from the cache
 	ttlInSeconds uint
 
 	// how long a message is initially buffered before it can be decisioned on
 	initBufferTTLInSeconds uint
+
+	// how long a tombstone is kept before it is garbage-collected
+	tombstoneTTLInSeconds uint
+
+	// next deadline of each entry (keyed by registryKey)
+	timers *timerheap.Heap
+
+	// source of the current time for the registry and everything built on it
+	clock clock.Clock
+}
+
+// HostState is what the registry knows about a host as a whole
+type HostState struct {
+	// Down - set while a liveness service of the host is failing or silent
+	Down bool
+	// Since - when the host went down
+	Since time.Time
+	// Cause - what brought the host down (e.g. "ping is CRITICAL")
+	Cause string
+	// Held - the number of service alerts held while the host is down
+	Held int
 }
 
 // MessageEntry is something to store in the Registry
 type MessageEntry struct {
+	host               string
+	service            string
+	phase              entryPhase
 	message            *Message
-	prevMessage        *Message
+	receivedAt         time.Time
 	initBufferExpireAt time.Time
 	expireAt           time.Time
+	tombstoneExpireAt  time.Time
 	flap               *flapper.Flapper
+
+	// the policies matching the entry, in order (see policy.go and 'policyAt')
+	policies []*Policy
+
+	// the states reported since the entry started buffering
+	buffered bufferSummary
+	// the init buffer was extended to hold a recovery (see recovery.go)
+	recoveryHeld bool
+
+	// the state the upstream was last told about (only valid if upstreamKnown)
+	upstreamState uint16
+	upstreamKnown bool
+	// the last client result that was sent upstream (nil if nbad made up what was sent)
+	upstreamMessage *Message
+	// the last notification held back and what holds it (see hold.go)
+	held   *Notification
+	heldBy *hold
+	// the upstream state was collected by a digest rather than sent (see digest.go)
+	digested bool
+
+	// the dependencies the entry is a child of (see dependency.go)
+	dependencies []*Dependency
+
+	// how often the service is expected to report (0 if it is not watched for freshness)
+	freshnessInterval time.Duration
+	// when the service is considered stale if it has not reported
+	freshnessDeadline time.Time
+	// set once a stale alert has been raised, cleared when the service reports again
+	freshnessAlerted bool
+
+	// nbad sends results of its own for the service (e.g. a digest), its tombstone is kept
+	owned bool
+}
+
+func newRegistry(ttlInSeconds uint, initBufferTTLInSeconds uint, tombstoneTTLInSeconds uint, c clock.Clock) *Registry {
+	return &Registry{
+		cache:                  make(map[string]*MessageEntry),
+		hosts:                  make(map[string]*HostState),
+		ttlInSeconds:           ttlInSeconds,
+		initBufferTTLInSeconds: initBufferTTLInSeconds,
+		tombstoneTTLInSeconds:  tombstoneTTLInSeconds,
+		timers:                 timerheap.New(),
+		clock:                  c,
+	}
+}
+
+// registryKey - entries are tracked per host and service
+func registryKey(host string, service string) string {
+	return host + "/" + service
+}
+
+// key returns the registry key for the message
+func (m *Message) key() string {
+	return registryKey(m.Host, m.Service)
 }
 
 // Contains checks to see if the message is currently in the registry.
 func (r *Registry) contains(message *Message) bool {
-	if _, ok := r.cache[message.Service]; ok {
+	if _, ok := r.cache[message.key()]; ok {
 		return true
 	}
 	return false
 }
 
-// Update stores message in the registry or updates it if it's already there
-func (r *Registry) update(message *Message) {
-	me := &MessageEntry{
-		message:            message,
-		expireAt:           time.Now().Add(time.Duration(r.ttlInSeconds) * time.Second),
-		initBufferExpireAt: time.Now().Add(time.Duration(Config().MessageInitBufferTimeSeconds) * time.Second),
-		flap:               flapper.NewFlapper(Config().FlapCountThreshold, Config().MessageInitBufferTimeSeconds),
+// Update stores message in the registry or updates it if it's already there. A new entry
+// (or one that was expired or tombstoned) starts buffering, see MessageEntry.buffer.
+func (r *Registry) update(message *Message) *MessageEntry {
+	now := r.clock.Now()
+	entry, ok := r.cache[message.key()]
+	if !ok {
+		entry = r.newEntry(message.Host, message.Service)
+		r.cache[message.key()] = entry
 	}
-	if prev := r.get(message.Service); prev != nil {
-		me.prevMessage = prev
+	if entry.flap == nil {
+		// new, or expected by the freshness manifest but this is the first time it reported
+		// state changes are counted within the init buffer, at least a second without one
+		window := uint(r.initBufferFor(entry) / time.Second)
+		if window == 0 {
+			window = 1
+		}
+		entry.flap = flapper.NewFlapperWithClock(Config().flapThresholdFor(entry.policyAt(now)), window, r.clock)
 	}
-	r.cache[message.Service] = me
+	// an expectation from the manifest sticks with the service
+	if entry.freshnessInterval == 0 {
+		entry.freshnessInterval = Config().freshnessIntervalFor(entry.policyAt(now))
+	}
+
+	r.buffer(entry, message, now)
+	return entry
 }
 
-func (r *Registry) get(key string) *Message {
-	if ce, ok := r.cache[key]; ok {
-		return ce.message
+// newEntry - an entry for the host and service, with the policies matching them
+func (r *Registry) newEntry(host string, service string) *MessageEntry {
+	return &MessageEntry{
+		host:         host,
+		service:      service,
+		policies:     Config().policiesFor(host, service),
+		dependencies: Config().dependenciesFor(host, service),
 	}
-	return nil
 }
 
-func (r *Registry) getPrev(key string) *Message {
-	if ce, ok := r.cache[key]; ok {
-		return ce.prevMessage
+// policyAt - the policy that applies to the entry at the given time (nil for the defaults)
+func (e *MessageEntry) policyAt(now time.Time) *Policy {
+	return firstActivePolicy(e.policies, now)
+}
+
+// ttlFor - the message cache ttl of the entry, from its policy or the registry default
+func (r *Registry) ttlFor(entry *MessageEntry) time.Duration {
+	ttl := r.ttlInSeconds
+	if p := entry.policyAt(r.clock.Now()); p != nil && p.MessageCacheTTLInSeconds != nil {
+		ttl = *p.MessageCacheTTLInSeconds
 	}
-	return nil
+	return time.Duration(ttl) * time.Second
+}
+
+// initBufferFor - the init buffer time of the entry, from its policy or the registry default
+func (r *Registry) initBufferFor(entry *MessageEntry) time.Duration {
+	buffer := r.initBufferTTLInSeconds
+	if p := entry.policyAt(r.clock.Now()); p != nil && p.MessageInitBufferTimeSeconds != nil {
+		buffer = *p.MessageInitBufferTimeSeconds
+	}
+	return time.Duration(buffer) * time.Second
 }
 
-func (r *Registry) getFlap(key string) *flapper.Flapper {
-	if ce, ok := r.cache[key]; ok {
-		return ce.flap
+// buffer - (any phase) -> buffering. Stores the message and (re)starts the init buffer.
+func (r *Registry) buffer(entry *MessageEntry, message *Message, now time.Time) {
+	if entry.phase != phaseBuffering {
+		entry.buffered.reset()
+	}
+	entry.phase = phaseBuffering
+	entry.recoveryHeld = false
+	entry.initBufferExpireAt = now.Add(r.initBufferFor(entry))
+	r.refresh(entry, message, now)
+}
+
+// refresh - records that the service reported without changing its phase
+func (r *Registry) refresh(entry *MessageEntry, message *Message, now time.Time) {
+	if entry.phase == phaseBuffering {
+		entry.buffered.add(message)
+	}
+	entry.message = message
+	entry.receivedAt = now
+	entry.expireAt = now.Add(r.ttlFor(entry))
+	entry.freshnessAlerted = false
+	if entry.freshnessInterval > 0 {
+		entry.freshnessDeadline = now.Add(entry.freshnessInterval)
+	}
+	r.schedule(entry)
+}
+
+// decide - buffering -> decided, once the init buffer has expired
+func (r *Registry) decide(entry *MessageEntry, now time.Time) bool {
+	if entry.phase != phaseBuffering || now.Before(entry.initBufferExpireAt) {
+		return false
+	}
+	entry.phase = phaseDecided
+	r.schedule(entry)
+	return true
+}
+
+// holdRecovery - buffering -> buffering, once the init buffer has expired. Extends the init
+// buffer by the hold, once per buffering period.
+func (r *Registry) holdRecovery(entry *MessageEntry, hold time.Duration, now time.Time) bool {
+	if entry.phase != phaseBuffering || entry.recoveryHeld || now.Before(entry.initBufferExpireAt) {
+		return false
+	}
+	entry.recoveryHeld = true
+	entry.initBufferExpireAt = now.Add(hold)
+	r.schedule(entry)
+	return true
+}
+
+// expire - decided -> expired, once the ttl has been reached
+func (r *Registry) expire(entry *MessageEntry, now time.Time) bool {
+	if entry.phase != phaseDecided || now.Before(entry.expireAt) {
+		return false
+	}
+	entry.phase = phaseExpired
+	r.schedule(entry)
+	return true
+}
+
+// tombstone - expired -> tombstoned. The entry is garbage-collected after the tombstone ttl.
+func (r *Registry) tombstone(entry *MessageEntry, now time.Time) bool {
+	if entry.phase != phaseExpired {
+		return false
+	}
+	entry.phase = phaseTombstoned
+	entry.tombstoneExpireAt = now.Add(time.Duration(r.tombstoneTTLInSeconds) * time.Second)
+	r.schedule(entry)
+	return true
+}
+
+// collect - tombstoned -> removed, once the tombstone ttl has been reached. Services that are
+// expected to report (freshness) and services nbad reports itself are never removed.
+func (r *Registry) collect(entry *MessageEntry, now time.Time) bool {
+	if entry.phase != phaseTombstoned || entry.freshnessInterval > 0 || entry.owned ||
+		now.Before(entry.tombstoneExpireAt) {
+		return false
+	}
+	key := registryKey(entry.host, entry.service)
+	delete(r.cache, key)
+	r.timers.Remove(key)
+	return true
+}
+
+// nextDeadline returns the next time something needs to happen to the entry. ok is false if
+// nothing will happen until the service reports again.
+func (e *MessageEntry) nextDeadline() (next time.Time, ok bool) {
+	consider := func(t time.Time) {
+		if !ok || t.Before(next) {
+			next, ok = t, true
+		}
+	}
+
+	if e.freshnessInterval > 0 && !e.freshnessAlerted {
+		consider(e.freshnessDeadline)
+	}
+	switch e.phase {
+	case phaseBuffering:
+		consider(e.initBufferExpireAt)
+	case phaseDecided:
+		consider(e.expireAt)
+	case phaseTombstoned:
+		if e.freshnessInterval == 0 && !e.owned {
+			consider(e.tombstoneExpireAt)
+		}
+	}
+	return next, ok
+}
+
+// pendingState - the state upstream has, or will be told about once the entry is no longer silenced
+func (e *MessageEntry) pendingState() (uint16, bool) {
+	if e.held != nil {
+		return e.held.Message.State, true
+	}
+	return e.upstreamState, e.upstreamKnown
+}
+
+// schedule - keeps the timer heap in line with the entry's next deadline
+func (r *Registry) schedule(entry *MessageEntry) {
+	key := registryKey(entry.host, entry.service)
+	if at, ok := entry.nextDeadline(); ok {
+		r.timers.Schedule(key, at)
+	} else {
+		r.timers.Remove(key)
+	}
+}
+
+// noteUpstream records the state the upstream was told about
+func (r *Registry) noteUpstream(entry *MessageEntry, state uint16) {
+	entry.upstreamState = state
+	entry.upstreamKnown = true
+}
+
+// host - the state of the host, created as up if it is not known yet
+func (r *Registry) host(name string) *HostState {
+	h, ok := r.hosts[name]
+	if !ok {
+		h = &HostState{}
+		r.hosts[name] = h
+	}
+	return h
+}
+
+// placeholder - the entry for the host and service, a tombstone is created for it if it does not
+// exist yet. Used for results nbad sends without the client having reported anything.
+func (r *Registry) placeholder(host string, service string) *MessageEntry {
+	key := registryKey(host, service)
+	entry, ok := r.cache[key]
+	if !ok {
+		now := r.clock.Now()
+		entry = r.newEntry(host, service)
+		entry.phase = phaseTombstoned
+		entry.receivedAt = now
+		entry.tombstoneExpireAt = now.Add(time.Duration(r.tombstoneTTLInSeconds) * time.Second)
+		r.cache[key] = entry
+		r.schedule(entry)
+	}
+	return entry
+}
+
+// own - the entry for a service nbad sends results for itself, created as a placeholder if it
+// does not exist yet. Unlike other tombstones it is never collected, so what upstream was told
+// is not forgotten.
+func (r *Registry) own(host string, service string) *MessageEntry {
+	entry := r.placeholder(host, service)
+	if !entry.owned {
+		entry.owned = true
+		r.schedule(entry)
+	}
+	return entry
+}
+
+// expect - start watching a service for freshness, even if it has never reported
+func (r *Registry) expect(host string, service string, interval time.Duration) {
+	key := registryKey(host, service)
+	entry, ok := r.cache[key]
+	if ok {
+		entry.freshnessInterval = interval
+		entry.freshnessDeadline = entry.receivedAt.Add(interval)
+	} else {
+		entry = r.newEntry(host, service)
+		entry.phase = phaseTombstoned
+		entry.receivedAt = r.clock.Now()
+		entry.freshnessInterval = interval
+		entry.freshnessDeadline = r.clock.Now().Add(interval)
+		r.cache[key] = entry
+	}
+	r.schedule(entry)
+}
+
+func (r *Registry) getEntry(key string) *MessageEntry {
+	return r.cache[key]
+}
+
+// get returns the last message for the service, unless the entry is only a tombstone
+func (r *Registry) get(key string) *Message {
+	if ce, ok := r.cache[key]; ok && ce.phase != phaseTombstoned {
+		return ce.message
 	}
 	return nil
 }
@@ -83,7 +446,11 @@ func (r *Registry) getFlap(key string) *flapper.Flapper {
 func (r *Registry) summaryString() string {
 	s := ""
 	for k, v := range r.cache {
-		entry := fmt.Sprintf("\t%s | %s | %s\n", k, stateName(v.message.State), v.message.Message)
+		if v.message == nil {
+			s = s + fmt.Sprintf("\t%s | (never reported)\n", k)
+			continue
+		}
+		entry := fmt.Sprintf("\t%s | %s | %s | %s\n", k, v.phase, stateName(v.message.State), v.message.Message)
 		s = s + entry
 	}
 	return s
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/JohnMurray/nbad/clock"
+)
+
+func newTestRegistry(c clock.Clock) *Registry {
+	return newRegistry(60, 10, 3600, c)
+}
+
+// newLifecycleTest returns a registry on a fake clock with a single CRITICAL entry in it
+func newLifecycleTest(t *testing.T) (*Registry, *MessageEntry, *clock.Fake) {
+	useTestConfig(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10})
+	clk := clock.NewFake(time.Unix(1000, 0))
+	r := newTestRegistry(clk)
+	entry := r.update(&Message{Host: "h", Service: "s", State: stateCritical})
+	return r, entry, clk
+}
+
+func TestNewMessageStartsBuffering(t *testing.T) {
+	r, entry, _ := newLifecycleTest(t)
+
+	if entry.phase != phaseBuffering {
+		t.Errorf("Expected new entry to be %s, was %s", phaseBuffering, entry.phase)
+	}
+	if r.get(registryKey("h", "s")) == nil {
+		t.Errorf("Expected message to be stored under its host and service")
+	}
+}
+
+func TestDecideOnlyAfterInitBufferAndOnlyOnce(t *testing.T) {
+	r, entry, clk := newLifecycleTest(t)
+
+	if r.decide(entry, clk.Now()) {
+		t.Errorf("Should not decide before the init buffer has expired")
+	}
+	clk.Advance(10 * time.Second)
+	if !r.decide(entry, clk.Now()) {
+		t.Errorf("Should decide once the init buffer has expired")
+	}
+	if r.decide(entry, clk.Now()) {
+		t.Errorf("Should only decide once")
+	}
+}
+
+func TestExpireOnlyDecidedEntriesAndOnlyOnce(t *testing.T) {
+	r, entry, clk := newLifecycleTest(t)
+	later := clk.Now().Add(60 * time.Second)
+
+	if r.expire(entry, later) {
+		t.Errorf("Should not expire an entry that is still buffering")
+	}
+	r.decide(entry, later)
+	if r.expire(entry, clk.Now()) {
+		t.Errorf("Should not expire before the ttl")
+	}
+	if !r.expire(entry, later) {
+		t.Errorf("Should expire once the ttl has been reached")
+	}
+	if r.expire(entry, later) {
+		t.Errorf("Should only expire once")
+	}
+}
+
+func TestTombstoneOnlyExpiredEntries(t *testing.T) {
+	r, entry, clk := newLifecycleTest(t)
+	later := clk.Now().Add(60 * time.Second)
+
+	if r.tombstone(entry, later) {
+		t.Errorf("Should not tombstone an entry that has not expired")
+	}
+	r.decide(entry, later)
+	r.expire(entry, later)
+	if !r.tombstone(entry, later) {
+		t.Errorf("Should tombstone an expired entry")
+	}
+	if r.tombstone(entry, later) {
+		t.Errorf("Should only tombstone once")
+	}
+	if r.get(registryKey("h", "s")) != nil {
+		t.Errorf("Tombstoned entries should not be returned by get")
+	}
+}
+
+func TestMessageRevivesTombstoneAndKeepsUpstreamState(t *testing.T) {
+	r, entry, clk := newLifecycleTest(t)
+	later := clk.Now().Add(60 * time.Second)
+	r.decide(entry, later)
+	r.noteUpstream(entry, stateCritical)
+	r.expire(entry, later)
+	r.tombstone(entry, later)
+
+	revived := r.update(&Message{Host: "h", Service: "s", State: stateOk})
+	if revived != entry || revived.phase != phaseBuffering {
+		t.Errorf("Expected tombstone to be revived into %s, was %s", phaseBuffering, revived.phase)
+	}
+	if !revived.upstreamKnown || revived.upstreamState != stateCritical {
+		t.Errorf("Expected revived entry to remember the upstream state")
+	}
+}
+
+func TestGarbageCollectionOfOldTombstones(t *testing.T) {
+	r, entry, clk := newLifecycleTest(t)
+	later := clk.Now().Add(60 * time.Second)
+	r.decide(entry, later)
+	r.expire(entry, later)
+	r.tombstone(entry, later)
+
+	if r.collect(entry, later.Add(time.Minute)) {
+		t.Errorf("Should not collect tombstones younger than the tombstone ttl")
+	}
+	if !r.collect(entry, later.Add(time.Hour)) {
+		t.Errorf("Expected tombstone to be collected")
+	}
+	if r.getEntry(registryKey("h", "s")) != nil {
+		t.Errorf("Collected tombstone is still in the registry")
+	}
+}
+
+func TestGarbageCollectionKeepsExpectedServices(t *testing.T) {
+	r, _, clk := newLifecycleTest(t)
+	r.expect("h", "heartbeat", time.Minute)
+	entry := r.getEntry(registryKey("h", "heartbeat"))
+
+	if r.collect(entry, clk.Now().Add(24*time.Hour)) {
+		t.Errorf("Services from the freshness manifest should never be collected")
+	}
+}
+
+func TestTransitionsKeepTimerHeapInLine(t *testing.T) {
+	r, entry, clk := newLifecycleTest(t)
+
+	if _, at, _ := r.timers.Next(); at != entry.initBufferExpireAt {
+		t.Errorf("Expected a buffering entry to wait on its init buffer")
+	}
+	later := clk.Now().Add(60 * time.Second)
+	r.decide(entry, later)
+	if _, at, _ := r.timers.Next(); at != entry.expireAt {
+		t.Errorf("Expected a decided entry to wait on its ttl")
+	}
+	r.expire(entry, later)
+	if r.timers.Len() != 0 {
+		t.Errorf("Expected an expired entry to have no deadline")
+	}
+	r.tombstone(entry, later)
+	if _, at, _ := r.timers.Next(); at != entry.tombstoneExpireAt {
+		t.Errorf("Expected a tombstone to wait on the tombstone ttl")
+	}
+}
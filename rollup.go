@@ -0,0 +1,239 @@
+package main
+
+/**
+ * File: rollup.go
+ *
+ * For fleets of interchangeable hosts no single instance matters, what matters is how the fleet
+ * as a whole is doing. A rollup is a service nbad makes up from the services matching its host
+ * and service globs (the members), e.g. every "api-health" on "api-*" hosts. Its state follows
+ * the rollup's rules:
+ *
+ *   - CRITICAL if at least critical_percent of the members are CRITICAL, or more than
+ *     critical_silent of them are silent
+ *   - WARNING if at least warning_percent of the members are WARNING or worse, or more than
+ *     warning_silent of them are silent
+ *   - OK otherwise (UNKNOWN if there are no members)
+ *
+ * A member is silent once it has missed its freshness interval (see freshness.go). Members that
+ * expire are no longer members, which is what happens to hosts that are scaled away. Rules that
+ * are 0 are not checked.
+ *
+ * Rollups are computed from the registry when the gateway wakes up, at most once a second since
+ * counting goes through every service, and sent upstream as their own service whenever their
+ * state changes. The results of the members themselves can be
+ * suppressed, so that only the rollup is sent. The rollup then stands in for upstream: a member's
+ * results are only decided on again when its state changes.
+ */
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// rollupInterval - how often the rollups are computed at most
+const rollupInterval = time.Second
+
+// Rollup is a service computed from the services matching Host and Service (globs)
+type Rollup struct {
+	// Name - identifies the rollup in logs and is its default service
+	Name string `json:"name"`
+
+	// Host - glob pattern matched against the host name of the members (empty matches all)
+	Host string `json:"host"`
+
+	// Service - glob pattern matched against the service name of the members (empty matches all)
+	Service string `json:"service"`
+
+	// RollupHost - host the rollup is sent for (default "nbad")
+	RollupHost string `json:"rollup_host"`
+
+	// RollupService - service the rollup is sent as (default the name of the rollup)
+	RollupService string `json:"rollup_service"`
+
+	// CriticalPercent - share of CRITICAL members that makes the rollup CRITICAL
+	CriticalPercent uint `json:"critical_percent"`
+
+	// CriticalSilent - the rollup is CRITICAL when more than this many members are silent
+	CriticalSilent uint `json:"critical_silent"`
+
+	// WarningPercent - share of WARNING (or worse) members that makes the rollup WARNING
+	WarningPercent uint `json:"warning_percent"`
+
+	// WarningSilent - the rollup is WARNING when more than this many members are silent
+	WarningSilent uint `json:"warning_silent"`
+
+	// SuppressMembers - don't send the results of the members upstream
+	SuppressMembers bool `json:"suppress_members"`
+
+	hostRegex    *regexp.Regexp
+	serviceRegex *regexp.Regexp
+}
+
+// String describes the rollup, for log and error messages
+func (r *Rollup) String() string {
+	return fmt.Sprintf("rollup '%s'", r.Name)
+}
+
+// matches returns true if the host and service are a member of the rollup. The rollup itself
+// never is.
+func (r *Rollup) matches(host string, service string) bool {
+	if host == r.RollupHost && service == r.RollupService {
+		return false
+	}
+	return matchName(host, r.hostRegex) && matchName(service, r.serviceRegex)
+}
+
+func (r *Rollup) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("rollup '%s/%s': needs a name", r.Host, r.Service)
+	}
+	var err error
+	if r.hostRegex, err = compileMatcher("host", r.Host, ""); err != nil {
+		return fmt.Errorf("%s: %v", r, err)
+	}
+	if r.serviceRegex, err = compileMatcher("service", r.Service, ""); err != nil {
+		return fmt.Errorf("%s: %v", r, err)
+	}
+	if r.CriticalPercent > 100 || r.WarningPercent > 100 {
+		return fmt.Errorf("%s: percentages can't be over 100", r)
+	}
+	if r.CriticalPercent == 0 && r.CriticalSilent == 0 && r.WarningPercent == 0 && r.WarningSilent == 0 {
+		return fmt.Errorf("%s: needs at least one rule", r)
+	}
+	if r.RollupHost == "" {
+		r.RollupHost = nbadHost
+	}
+	if r.RollupService == "" {
+		r.RollupService = r.Name
+	}
+	return nil
+}
+
+// compileRollups validates the rollups and fills in their defaults
+func (c *NbadConfig) compileRollups() error {
+	names := nameSet{}
+	for _, r := range c.Rollups {
+		if err := r.compile(); err != nil {
+			return err
+		}
+		if err := names.add(r.Name, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// suppressingRollup returns the rollup suppressing the results of the host and service, nil if
+// none does
+func (c *NbadConfig) suppressingRollup(host string, service string) *Rollup {
+	for _, r := range c.Rollups {
+		if r.SuppressMembers && r.matches(host, service) {
+			return r
+		}
+	}
+	return nil
+}
+
+// rollupCount is what the members of a rollup are up to
+type rollupCount struct {
+	members  int
+	critical map[string]bool
+	warning  map[string]bool
+	silent   map[string]bool
+}
+
+// count goes through the registry for the members of the rollup
+func (r *Rollup) count(registry *Registry) *rollupCount {
+	c := &rollupCount{critical: map[string]bool{}, warning: map[string]bool{}, silent: map[string]bool{}}
+	for key, entry := range registry.cache {
+		if entry.message == nil || entry.phase == phaseExpired || entry.phase == phaseTombstoned ||
+			!r.matches(entry.host, entry.service) {
+			continue
+		}
+		c.members++
+		switch {
+		case entry.freshnessAlerted:
+			c.silent[key] = true
+		case entry.message.State == stateCritical:
+			c.critical[key] = true
+		case severity(entry.message.State) >= severity(stateWarning):
+			c.warning[key] = true
+		}
+	}
+	return c
+}
+
+// percent returns the share of the members in the set, in percent
+func (c *rollupCount) percent(set map[string]bool) uint {
+	if c.members == 0 {
+		return 0
+	}
+	return uint(len(set) * 100 / c.members)
+}
+
+// state returns the state of the rollup for the count
+func (r *Rollup) state(c *rollupCount) uint16 {
+	if c.members == 0 {
+		return stateUnknown
+	}
+	failing := len(c.critical) + len(c.warning)
+	switch {
+	case r.CriticalPercent > 0 && c.percent(c.critical) >= r.CriticalPercent,
+		r.CriticalSilent > 0 && uint(len(c.silent)) > r.CriticalSilent:
+		return stateCritical
+	case r.WarningPercent > 0 && uint(failing*100/c.members) >= r.WarningPercent,
+		r.WarningSilent > 0 && uint(len(c.silent)) > r.WarningSilent:
+		return stateWarning
+	}
+	return stateOk
+}
+
+// output describes the count, listing the members that are not OK
+func (c *rollupCount) output() string {
+	if c.members == 0 {
+		return "no members reporting"
+	}
+	parts := []string{fmt.Sprintf("%d members", c.members)}
+	for _, s := range []struct {
+		name string
+		set  map[string]bool
+	}{{"CRITICAL", c.critical}, {"WARNING or UNKNOWN", c.warning}, {"silent", c.silent}} {
+		if len(s.set) > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s (%d%%): %s", len(s.set), s.name, c.percent(s.set),
+				listServices(s.set)))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// updateRollups - computes the rollups and sends those whose state changed
+func (g *Gateway) updateRollups() {
+	now := g.clock.Now()
+	if now.Before(g.rollupsAt) {
+		return
+	}
+	g.rollupsAt = now.Add(rollupInterval)
+	for _, r := range Config().Rollups {
+		count := r.count(g.registry)
+		state := r.state(count)
+		// the entry for the rollup is only created once there is something to send
+		var current uint16
+		var known bool
+		if entry := g.registry.getEntry(registryKey(r.RollupHost, r.RollupService)); entry != nil {
+			current, known = entry.pendingState()
+		}
+		if (known && current == state) || (!known && count.members == 0) {
+			// unchanged, or nothing to say yet
+			continue
+		}
+		Logger().Info.Printf("%s is %s (%s)\n", r, stateName(state), count.output())
+		from := &Message{Host: r.RollupHost, Service: r.RollupService}
+		g.decision(ruleRollup, g.registry.own(r.RollupHost, r.RollupService), nil, &Notification{
+			Message:     newSynthesizedMessage(from, state, count.output(), uint32(now.Unix())),
+			Reason:      "rollup changed",
+			Synthesized: true,
+		})
+	}
+}
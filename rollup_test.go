@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newRollupTest(t *testing.T, c *NbadConfig) (*Gateway, *recordingUpstream, func(state func(i int) uint16)) {
+	c.FlapCountThreshold, c.MessageInitBufferTimeSeconds = 5, 10
+	g, upstream, clk := newTestGateway(t, c)
+	report := func(state func(i int) uint16) {
+		for i := 1; i <= 10; i++ {
+			if s := state(i); s != stateUnknown {
+				g.handleMessage(&Message{Host: fmt.Sprintf("api-%d", i), Service: "api-health", State: s})
+			}
+		}
+		after(g, clk, 10*time.Second)
+	}
+	return g, upstream, report
+}
+
+func TestRollupFollowsShareOfCriticalMembers(t *testing.T) {
+	_, upstream, report := newRollupTest(t, &NbadConfig{Rollups: []*Rollup{{Name: "api-health",
+		Host: "api-*", Service: "api-health", CriticalPercent: 30, SuppressMembers: true}}})
+
+	report(func(i int) uint16 { return stateOk })
+	if len(upstream.sent) != 1 || upstream.sent[0].Message.Host != "nbad" || upstream.sent[0].Message.State != stateOk {
+		t.Fatalf("Expected only the rollup to be sent, as OK, got %d notifications", len(upstream.sent))
+	}
+
+	// 2 of 10 is not enough
+	report(func(i int) uint16 {
+		if i <= 2 {
+			return stateCritical
+		}
+		return stateOk
+	})
+	if len(upstream.sent) != 1 {
+		t.Errorf("Expected the rollup to stay OK with 20%% of its members CRITICAL")
+	}
+
+	report(func(i int) uint16 {
+		if i <= 3 {
+			return stateCritical
+		}
+		return stateOk
+	})
+	if len(upstream.sent) != 2 {
+		t.Fatalf("Expected the rollup to go CRITICAL with 30%% of its members CRITICAL")
+	}
+	n := upstream.sent[1]
+	if n.Message.State != stateCritical || !strings.Contains(n.Message.Message, "3 CRITICAL (30%): api-1/api-health") {
+		t.Errorf("Expected the rollup to list its CRITICAL members, got %s: %s", stateName(n.Message.State), n.Message.Message)
+	}
+}
+
+func TestRollupCountsSilentMembers(t *testing.T) {
+	_, upstream, report := newRollupTest(t, &NbadConfig{FreshnessThresholdInSeconds: 15,
+		Rollups: []*Rollup{{Name: "api", Service: "api-health", CriticalSilent: 2}}})
+
+	report(func(i int) uint16 { return stateOk })
+	upstream.sent = nil
+
+	// api-1 and api-2 stop reporting, which is not more than 2
+	silent := func(n int) func(i int) uint16 {
+		return func(i int) uint16 {
+			if i <= n {
+				return stateUnknown
+			}
+			return stateOk
+		}
+	}
+	report(silent(2))
+	report(silent(2))
+	rollup := func() *Notification {
+		var last *Notification
+		for _, n := range upstream.sent {
+			if n.Message.Service == "api" {
+				last = n
+			}
+		}
+		return last
+	}
+	if n := rollup(); n != nil && n.Message.State == stateCritical {
+		t.Errorf("Expected the rollup to stay OK with 2 members silent")
+	}
+
+	// then api-3 too
+	report(silent(3))
+	report(silent(3))
+	if n := rollup(); n == nil || n.Message.State != stateCritical || !strings.Contains(n.Message.Message, "3 silent") {
+		t.Errorf("Expected the rollup to go CRITICAL with 3 members silent, got %v", n)
+	}
+}
+
+func TestRollupNeedsARule(t *testing.T) {
+	c := &NbadConfig{Rollups: []*Rollup{{Name: "api", Service: "api-health"}}}
+	if err := c.compile(); err == nil {
+		t.Errorf("Expected a rollup without rules to be rejected")
+	}
+}
+
+func TestRollupEntryIsOnlyCreatedWhenSent(t *testing.T) {
+	g, upstream, report := newRollupTest(t, &NbadConfig{Rollups: []*Rollup{{Name: "api", Service: "api-health",
+		CriticalPercent: 50}, {Name: "db", Service: "db", CriticalPercent: 50}}})
+	report(func(i int) uint16 { return stateCritical })
+	if g.registry.getEntry(registryKey("nbad", "db")) != nil {
+		t.Errorf("Expected no entry for a rollup without members")
+	}
+
+	// what upstream was told about the rollup outlives the tombstone ttl
+	for i := 0; i < 400; i++ {
+		report(func(i int) uint16 { return stateCritical })
+	}
+	for _, n := range upstream.sent[1:] {
+		if n.Message.Service == "api" {
+			t.Errorf("Expected the rollup to be sent once, got %s again", stateName(n.Message.State))
+		}
+	}
+}
+
+// the gateway wakes up for every deadline in the registry, which is many times a second with
+// 100k services
+func BenchmarkTickWithRollup100k(b *testing.B) {
+	g := newBenchmarkGateway(b, 100000, &Rollup{Name: "api", Host: "host-*", Service: "api-health", CriticalPercent: 50})
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		g.tick()
+	}
+}
+
+func TestSuppressedMembersAreOnlyDecidedWhenTheyChange(t *testing.T) {
+	g, _, report := newRollupTest(t, &NbadConfig{Rollups: []*Rollup{{Name: "api-health",
+		Host: "api-*", Service: "api-health", CriticalPercent: 30, SuppressMembers: true}}})
+	dir, err := ioutil.TempDir("", "nbad-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	g.auditLog, err = openAuditLog(filepath.Join(dir, "audit.jsonl"), 1024*1024, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report(func(i int) uint16 { return stateOk })
+	report(func(i int) uint16 { return stateOk })
+	report(func(i int) uint16 {
+		if i == 1 {
+			return stateCritical
+		}
+		return stateOk
+	})
+	g.auditLog.close()
+
+	f, _ := os.Open(g.auditLog.path)
+	defer f.Close()
+	suppressed := 0
+	err = queryAudit(f, &AuditQuery{}, func(r *AuditRecord) {
+		if r.Upstream == upstreamSuppressed {
+			suppressed++
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the 10 new members, then api-1 going CRITICAL
+	if suppressed != 11 {
+		t.Errorf("Expected 11 suppressed decisions, got %d", suppressed)
+	}
+}
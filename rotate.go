@@ -0,0 +1,102 @@
+package main
+
+/**
+ * File: rotate.go
+ *
+ * A simple size-based rotating file for the JSON-lines files nbad writes (captures, audit log).
+ * Once the file would grow past its max size it is rotated:
+ *
+ *    file -> file.1 -> file.2 -> ... -> file.N (the oldest is removed)
+ */
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// rotatingFile is safe to use from multiple goroutines
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+// openRotatingFile - opens (or creates) the file at path for appending
+func openRotatingFile(path string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("could not open '%s': %v", f.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not open '%s': %v", f.path, err)
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// write - writes a line to the file, rotating it first if it is full
+func (f *rotatingFile) write(line []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.size > 0 && f.size+int64(len(line)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := f.file.Write(line)
+	f.size += int64(n)
+	return err
+}
+
+// rotate - shifts the existing files along (dropping the oldest) and starts a new one
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxFiles))
+	for i := f.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+	if f.maxFiles > 0 {
+		if err := os.Rename(f.path, f.path+".1"); err != nil {
+			return fmt.Errorf("could not rotate '%s': %v", f.path, err)
+		}
+	} else {
+		os.Remove(f.path)
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// rotatedFiles returns the files that exist for path, oldest first
+func rotatedFiles(path string, maxFiles int) []string {
+	var files []string
+	for i := maxFiles; i >= 1; i-- {
+		rotated := fmt.Sprintf("%s.%d", path, i)
+		if _, err := os.Stat(rotated); err == nil {
+			files = append(files, rotated)
+		}
+	}
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files
+}
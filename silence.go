@@ -0,0 +1,461 @@
+package main
+
+/**
+ * File: silence.go
+ *
+ * Silences mute hosts or services for a while (e.g. during a deploy) without touching
+ * Nagios. The gateway keeps tracking the state of silenced services as usual, but anything
+ * it would send upstream for them is held on the entry instead. When the silence ends (or is
+ * removed) the last held result is sent, unless upstream already has that state.
+ *
+ * A silence can refer to a time period (see the timeperiod package), it is then only active
+ * while in that period, which makes for recurring silences (e.g. batch jobs that are allowed to
+ * fail overnight). Such a silence does not need an end.
+ *
+ * Silences come from the config file, or are created at runtime through the API (see api.go),
+ * which the 'silence' command talks to. Runtime silences are kept in the silences file so that
+ * they survive a restart, silences from the config file are not written to it.
+ */
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/JohnMurray/nbad/timeperiod"
+	"github.com/codegangsta/cli"
+)
+
+// Silence mutes the hosts and services it matches between Start and End
+type Silence struct {
+	// ID - assigned when the silence is created
+	ID string `json:"id"`
+
+	// Host - glob pattern matched against the host name (empty matches all hosts)
+	Host string `json:"host"`
+
+	// Service - glob pattern matched against the service name (empty matches all services)
+	Service string `json:"service"`
+
+	// Start - when the silence starts (defaults to when it is created)
+	Start time.Time `json:"start"`
+
+	// End - when the silence ends (only optional with a time period)
+	End time.Time `json:"end"`
+
+	// TimePeriod - name of the time period the silence is limited to (always if empty)
+	TimePeriod string `json:"timeperiod,omitempty"`
+
+	// Author - who created the silence
+	Author string `json:"author"`
+
+	// Comment - why the silence was created
+	Comment string `json:"comment"`
+
+	// fromConfig - silences from the config file are not persisted
+	fromConfig   bool
+	period       *timeperiod.Period
+	hostRegex    *regexp.Regexp
+	serviceRegex *regexp.Regexp
+}
+
+// validate checks the silence and fills in its start if missing
+func (s *Silence) validate(now time.Time) error {
+	if s.Author == "" {
+		return fmt.Errorf("a silence needs an author")
+	}
+	if s.Start.IsZero() {
+		s.Start = now
+	}
+	if err := s.resolve(); err != nil {
+		return err
+	}
+	if s.End.IsZero() && s.period != nil {
+		return nil
+	}
+	if !s.End.After(s.Start) {
+		return fmt.Errorf("a silence has to end after it starts")
+	}
+	return nil
+}
+
+// resolve compiles the patterns of the silence and looks up the time period it refers to
+func (s *Silence) resolve() error {
+	var err error
+	if s.hostRegex, err = compileMatcher("host", s.Host, ""); err != nil {
+		return err
+	}
+	if s.serviceRegex, err = compileMatcher("service", s.Service, ""); err != nil {
+		return err
+	}
+	if s.TimePeriod == "" {
+		return nil
+	}
+	if Config() != nil {
+		s.period = Config().timePeriods[s.TimePeriod]
+	}
+	if s.period == nil {
+		return fmt.Errorf("unknown time period '%s'", s.TimePeriod)
+	}
+	return nil
+}
+
+// over returns true once the silence has ended for good
+func (s *Silence) over(now time.Time) bool {
+	return !s.End.IsZero() && !now.Before(s.End)
+}
+
+// active returns true if the silence applies to the host and service at the given time
+func (s *Silence) active(host string, service string, now time.Time) bool {
+	return !now.Before(s.Start) && !s.over(now) && (s.period == nil || s.period.Contains(now)) &&
+		matchName(host, s.hostRegex) && matchName(service, s.serviceRegex)
+}
+
+// silencesByStart orders silences by when they start
+type silencesByStart []*Silence
+
+func (s silencesByStart) Len() int           { return len(s) }
+func (s silencesByStart) Less(i, j int) bool { return s[i].Start.Before(s[j].Start) }
+func (s silencesByStart) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// SilenceStore holds the current silences. It is shared between the gateway and the API.
+type SilenceStore struct {
+	mu       sync.Mutex
+	path     string
+	silences map[string]*Silence
+	// silences that ended or were removed since the gateway last asked (see 'ended')
+	done []*Silence
+}
+
+// openSilenceStore loads the runtime silences from path (if set and it exists)
+func openSilenceStore(path string, now time.Time) (*SilenceStore, error) {
+	s := &SilenceStore{path: path, silences: make(map[string]*Silence)}
+	if path == "" {
+		return s, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("silences file: %v", err)
+	}
+	var silences []*Silence
+	if err := json.Unmarshal(data, &silences); err != nil {
+		return nil, fmt.Errorf("silences file '%s': %v", path, err)
+	}
+	for _, silence := range silences {
+		if silence.over(now) {
+			continue
+		}
+		if err := silence.resolve(); err != nil {
+			Logger().Warning.Printf("dropping silence %s: %v\n", silence.ID, err)
+			continue
+		}
+		s.silences[silence.ID] = silence
+	}
+	return s, nil
+}
+
+// add validates the silence, assigns it an ID and stores it
+func (s *SilenceStore) add(silence *Silence, now time.Time) error {
+	if err := silence.validate(now); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if silence.ID == "" {
+		silence.ID = newSilenceID()
+	}
+	if _, ok := s.silences[silence.ID]; ok {
+		return fmt.Errorf("a silence with id '%s' already exists", silence.ID)
+	}
+	s.silences[silence.ID] = silence
+	if silence.fromConfig {
+		return nil
+	}
+	if err := s.save(); err != nil {
+		// a silence that isn't saved would be gone after a restart
+		delete(s.silences, silence.ID)
+		return err
+	}
+	return nil
+}
+
+// errConfigSilence is returned when removing a silence from the config file, which would be
+// back after a restart
+var errConfigSilence = errors.New("silences from the config file can only be removed from the config file")
+
+// remove deletes the silence, returns false if there is no silence with that id
+func (s *SilenceStore) remove(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	silence, ok := s.silences[id]
+	if !ok {
+		return false, nil
+	}
+	if silence.fromConfig {
+		return true, errConfigSilence
+	}
+	delete(s.silences, id)
+	if err := s.save(); err != nil {
+		// a removal that isn't saved would be undone by a restart
+		s.silences[id] = silence
+		return true, err
+	}
+	s.done = append(s.done, silence)
+	return true, nil
+}
+
+// list returns the current silences, ordered by start
+func (s *SilenceStore) list() []*Silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	silences := make([]*Silence, 0, len(s.silences))
+	for _, silence := range s.silences {
+		silences = append(silences, silence)
+	}
+	sort.Sort(silencesByStart(silences))
+	return silences
+}
+
+// matching returns a silence active for the host and service, nil if there is none
+func (s *SilenceStore) matching(host string, service string, now time.Time) *Silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, silence := range s.silences {
+		if silence.active(host, service, now) {
+			return silence
+		}
+	}
+	return nil
+}
+
+// ended drops the silences that are over and returns them, along with any removed since
+// the last call
+func (s *SilenceStore) ended(now time.Time) []*Silence {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := false
+	for id, silence := range s.silences {
+		if silence.over(now) {
+			delete(s.silences, id)
+			s.done = append(s.done, silence)
+			expired = true
+		}
+	}
+	if expired {
+		if err := s.save(); err != nil {
+			Logger().Warning.Println("Failed to save silences", err.Error())
+		}
+	}
+	done := s.done
+	s.done = nil
+	return done
+}
+
+// save writes the runtime silences to the silences file (the caller holds the lock)
+func (s *SilenceStore) save() error {
+	if s.path == "" {
+		return nil
+	}
+	silences := []*Silence{}
+	for _, silence := range s.silences {
+		if !silence.fromConfig {
+			silences = append(silences, silence)
+		}
+	}
+	sort.Sort(silencesByStart(silences))
+	data, err := json.MarshalIndent(silences, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write then rename so a crash never leaves a half written file behind
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+func newSilenceID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%08x", time.Now().UnixNano()&0xffffffff)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newConfiguredSilenceStore - creates the silence store from the config: the silences file and
+// the silences listed in the config file
+func newConfiguredSilenceStore(now time.Time) (*SilenceStore, error) {
+	store, err := openSilenceStore(Config().SilencesFile, now)
+	if err != nil {
+		return nil, err
+	}
+	for i, silence := range Config().Silences {
+		silence.fromConfig = true
+		if silence.ID == "" {
+			silence.ID = fmt.Sprintf("config-%d", i+1)
+		}
+		if silence.over(now) {
+			continue
+		}
+		if err := store.add(silence, now); err != nil {
+			return nil, fmt.Errorf("silence %s from config: %v", silence.ID, err)
+		}
+	}
+	return store, nil
+}
+
+// printSilence writes a silence as a single line
+func printSilence(out io.Writer, s *Silence) {
+	host, service := s.Host, s.Service
+	if host == "" {
+		host = "*"
+	}
+	if service == "" {
+		service = "*"
+	}
+	end := "-"
+	if !s.End.IsZero() {
+		end = s.End.Format(time.RFC3339)
+	}
+	during := ""
+	if s.TimePeriod != "" {
+		during = fmt.Sprintf(" during '%s'", s.TimePeriod)
+	}
+	fmt.Fprintf(out, "%s  %s/%s  %s - %s%s  %s: %s\n", s.ID, host, service,
+		s.Start.Format(time.RFC3339), end, during, s.Author, s.Comment)
+}
+
+// apiURL returns the address of the API from the flag, or the config file
+func apiURL(c *cli.Context, configFile string) string {
+	address := c.String("api")
+	if address == "" {
+		InitConfig(configFile, TempLogger("SILENCE"))
+		address = Config().APIAddress
+	}
+	if address == "" {
+		TempLogger("SILENCE").Fatalln("no api_address configured, use --api")
+	}
+	if !strings.HasPrefix(address, "http://") && !strings.HasPrefix(address, "https://") {
+		address = "http://" + address
+	}
+	return strings.TrimSuffix(address, "/")
+}
+
+// apiError turns an unexpected API response into an error
+func apiError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+func silenceCommand(configFile *string) cli.Command {
+	apiFlag := cli.StringFlag{Name: "api", Usage: "Address of the nbad API (defaults to api_address from the config)"}
+	return cli.Command{
+		Name:  "silence",
+		Usage: "Manage the silences of a running nbad",
+		Subcommands: []cli.Command{
+			{
+				Name:  "add",
+				Usage: "Silence hosts and services for a while",
+				Flags: []cli.Flag{
+					apiFlag,
+					cli.StringFlag{Name: "host", Usage: "Glob of the hosts to silence (all if not set)"},
+					cli.StringFlag{Name: "service", Usage: "Glob of the services to silence (all if not set)"},
+					cli.StringFlag{Name: "start", Usage: "When the silence starts, RFC3339 (defaults to now)"},
+					cli.DurationFlag{Name: "duration", Value: time.Hour, Usage: "How long the silence lasts (0 for no end, with --timeperiod)"},
+					cli.StringFlag{Name: "timeperiod", Usage: "Only silence during this time period from the config"},
+					cli.StringFlag{Name: "author", EnvVar: "USER", Usage: "Who is creating the silence"},
+					cli.StringFlag{Name: "comment", Usage: "Why the silence is being created"},
+				},
+				Action: func(c *cli.Context) {
+					logger := TempLogger("SILENCE")
+					silence := &Silence{Host: c.String("host"), Service: c.String("service"),
+						Author: c.String("author"), Comment: c.String("comment"), Start: time.Now(),
+						TimePeriod: c.String("timeperiod")}
+					if start := c.String("start"); start != "" {
+						t, err := time.Parse(time.RFC3339, start)
+						if err != nil {
+							logger.Fatalf("invalid start '%s': %v\n", start, err)
+						}
+						silence.Start = t
+					}
+					if d := c.Duration("duration"); d > 0 {
+						silence.End = silence.Start.Add(d)
+					}
+
+					body, _ := json.Marshal(silence)
+					resp, err := http.Post(apiURL(c, *configFile)+"/silences", "application/json", bytes.NewReader(body))
+					if err != nil {
+						logger.Fatalln(err)
+					}
+					defer resp.Body.Close()
+					if resp.StatusCode != http.StatusCreated {
+						logger.Fatalln(apiError(resp))
+					}
+					if err := json.NewDecoder(resp.Body).Decode(silence); err != nil {
+						logger.Fatalln(err)
+					}
+					printSilence(os.Stdout, silence)
+				},
+			},
+			{
+				Name:  "list",
+				Usage: "List the current silences",
+				Flags: []cli.Flag{apiFlag},
+				Action: func(c *cli.Context) {
+					logger := TempLogger("SILENCE")
+					resp, err := http.Get(apiURL(c, *configFile) + "/silences")
+					if err != nil {
+						logger.Fatalln(err)
+					}
+					defer resp.Body.Close()
+					if resp.StatusCode != http.StatusOK {
+						logger.Fatalln(apiError(resp))
+					}
+					var silences []*Silence
+					if err := json.NewDecoder(resp.Body).Decode(&silences); err != nil {
+						logger.Fatalln(err)
+					}
+					for _, s := range silences {
+						printSilence(os.Stdout, s)
+					}
+				},
+			},
+			{
+				Name:      "remove",
+				Usage:     "Remove a silence, sending the true state of what it held",
+				ArgsUsage: "<id>",
+				Flags:     []cli.Flag{apiFlag},
+				Action: func(c *cli.Context) {
+					logger := TempLogger("SILENCE")
+					if len(c.Args()) != 1 {
+						logger.Fatalln("expected the id of the silence to remove")
+					}
+					req, _ := http.NewRequest("DELETE", apiURL(c, *configFile)+"/silences/"+c.Args().First(), nil)
+					resp, err := http.DefaultClient.Do(req)
+					if err != nil {
+						logger.Fatalln(err)
+					}
+					defer resp.Body.Close()
+					if resp.StatusCode != http.StatusNoContent {
+						logger.Fatalln(apiError(resp))
+					}
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/JohnMurray/nbad/timeperiod"
+
+	"github.com/JohnMurray/nbad/clock"
+)
+
+func TestSilenceValidation(t *testing.T) {
+	now := time.Unix(1000, 0)
+	tests := []*Silence{
+		{Host: "[", Author: "a", End: now.Add(time.Hour)},
+		{Host: "web*", End: now.Add(time.Hour)},
+		{Host: "web*", Author: "a", End: now},
+	}
+	for _, s := range tests {
+		if err := s.validate(now); err == nil {
+			t.Errorf("Expected %+v to be rejected", s)
+		}
+	}
+	s := &Silence{Host: "web*", Author: "a", End: now.Add(time.Hour)}
+	if err := s.validate(now); err != nil || !s.Start.Equal(now) {
+		t.Errorf("Expected a valid silence starting now, got %v (start %v)", err, s.Start)
+	}
+}
+
+func TestSilenceStorePersistsRuntimeSilences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nbad-silences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "silences.json")
+	now := time.Unix(1000, 0).UTC()
+
+	store, err := openSilenceStore(path, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime := &Silence{Host: "web1", Author: "a", Comment: "deploy", End: now.Add(time.Hour)}
+	if err := store.add(runtime, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.add(&Silence{ID: "config-1", Author: "a", End: now.Add(time.Hour), fromConfig: true}, now); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openSilenceStore(path, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	silences := reopened.list()
+	if len(silences) != 1 || silences[0].ID != runtime.ID || silences[0].Comment != "deploy" {
+		t.Fatalf("Expected only the runtime silence to be persisted, got %v", silences)
+	}
+
+	// silences that are over by the time nbad starts are dropped
+	reopened, _ = openSilenceStore(path, now.Add(2*time.Hour))
+	if len(reopened.list()) != 0 {
+		t.Errorf("Expected ended silences to be dropped on load")
+	}
+}
+
+func TestSilenceStoreKeepsInLineWithTheFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nbad-silences")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	now := time.Unix(1000, 0).UTC()
+	store, _ := openSilenceStore(filepath.Join(dir, "silences.json"), now)
+	store.add(&Silence{ID: "saved", Author: "a", End: now.Add(time.Hour)}, now)
+	store.add(&Silence{ID: "config-1", Author: "a", End: now.Add(time.Hour), fromConfig: true}, now)
+
+	// the file can no longer be written
+	store.path = filepath.Join(dir, "missing", "silences.json")
+	if err := store.add(&Silence{ID: "unsaved", Author: "a", End: now.Add(time.Hour)}, now); err == nil {
+		t.Errorf("Expected the silence not to be added when it can't be saved")
+	}
+	if ok, err := store.remove("saved"); !ok || err == nil {
+		t.Errorf("Expected the silence not to be removed when that can't be saved")
+	}
+	if ok, err := store.remove("config-1"); !ok || err != errConfigSilence {
+		t.Errorf("Expected silences from the config to be refused, got %v", err)
+	}
+	if silences := store.list(); len(silences) != 2 {
+		t.Errorf("Expected the silences to be left as they were, got %v", silences)
+	}
+	if ended := store.ended(now); len(ended) != 0 {
+		t.Errorf("Nothing should have ended, got %d", len(ended))
+	}
+}
+
+func TestSilenceStoreEnded(t *testing.T) {
+	now := time.Unix(1000, 0)
+	store, _ := openSilenceStore("", now)
+	store.add(&Silence{ID: "short", Author: "a", End: now.Add(time.Minute)}, now)
+	store.add(&Silence{ID: "long", Author: "a", End: now.Add(time.Hour)}, now)
+	store.add(&Silence{ID: "removed", Author: "a", End: now.Add(time.Hour)}, now)
+
+	if ended := store.ended(now); len(ended) != 0 {
+		t.Errorf("Nothing should have ended yet, got %d", len(ended))
+	}
+	if ok, _ := store.remove("removed"); !ok {
+		t.Errorf("Expected the silence to be removed")
+	}
+	ended := store.ended(now.Add(time.Minute))
+	if len(ended) != 2 {
+		t.Fatalf("Expected the removed and the short silence to have ended, got %d", len(ended))
+	}
+	if s := store.matching("h", "s", now.Add(time.Minute)); s == nil || s.ID != "long" {
+		t.Errorf("Expected the long silence to still match, got %v", s)
+	}
+}
+
+func newSilencedGateway(t *testing.T) (*Gateway, *recordingUpstream, *clock.Fake) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		MessageCacheTTLInSeconds: 60})
+	g.silences, _ = openSilenceStore("", clk.Now())
+	g.handleMessage(&Message{Host: "web1", Service: "http", State: stateOk})
+	after(g, clk, 10*time.Second)
+	g.silences.add(&Silence{ID: "deploy", Host: "web*", Author: "a", End: clk.Now().Add(10 * time.Minute)}, clk.Now())
+	return g, upstream, clk
+}
+
+func TestSilencedStateIsSentWhenSilenceEnds(t *testing.T) {
+	g, upstream, clk := newSilencedGateway(t)
+	g.handleMessage(&Message{Host: "web1", Service: "http", State: stateCritical})
+	after(g, clk, 10*time.Second)
+	for i := 0; i < 19; i++ {
+		g.handleMessage(&Message{Host: "web1", Service: "http", State: stateCritical})
+		after(g, clk, 30*time.Second)
+	}
+	if len(upstream.sent) != 1 {
+		t.Fatalf("Nothing should be sent while silenced, got %d notifications", len(upstream.sent))
+	}
+
+	g.handleMessage(&Message{Host: "web1", Service: "http", State: stateCritical})
+	after(g, clk, 30*time.Second)
+	if len(upstream.sent) != 2 || upstream.sent[1].Message.State != stateCritical {
+		t.Fatalf("Expected the CRITICAL once the silence ended, got %d notifications", len(upstream.sent))
+	}
+	g.handleMessage(&Message{Host: "web1", Service: "http", State: stateCritical})
+	after(g, clk, 30*time.Second)
+	if len(upstream.sent) != 2 {
+		t.Errorf("The held state should only be sent once, got %d notifications", len(upstream.sent))
+	}
+}
+
+func TestSilenceEndingSendsNothingIfStateRecovered(t *testing.T) {
+	g, upstream, clk := newSilencedGateway(t)
+	g.handleMessage(&Message{Host: "web1", Service: "http", State: stateCritical})
+	after(g, clk, 10*time.Second)
+	g.handleMessage(&Message{Host: "web1", Service: "http", State: stateOk})
+	after(g, clk, 10*time.Second)
+
+	after(g, clk, 10*time.Minute)
+	if len(upstream.sent) != 1 {
+		t.Errorf("The deploy's CRITICAL should never reach upstream, got %d notifications", len(upstream.sent))
+	}
+}
+
+func TestRemovingSilenceReleasesHeldState(t *testing.T) {
+	g, upstream, clk := newSilencedGateway(t)
+	g.handleMessage(&Message{Host: "web1", Service: "http", State: stateWarning})
+	after(g, clk, 10*time.Second)
+	g.silences.remove("deploy")
+	after(g, clk, time.Second)
+	if len(upstream.sent) != 2 || upstream.sent[1].Message.State != stateWarning {
+		t.Errorf("Expected the WARNING once the silence was removed, got %d notifications", len(upstream.sent))
+	}
+}
+
+func TestRecurringSilenceReleasesWhenItsTimePeriodEnds(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		TimePeriods: map[string]*timeperiod.Definition{
+			"overnight": {Ranges: map[string]string{"all": "00:00-06:00"}},
+		},
+		Silences: []*Silence{{Service: "batch-*", TimePeriod: "overnight", Author: "ops", Comment: "allowed to fail at night"}}})
+	var err error
+	if g.silences, err = newConfiguredSilenceStore(clk.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	// 00:16 at night, the failure is held
+	g.handleMessage(&Message{Host: "h", Service: "batch-import", State: stateCritical})
+	after(g, clk, 10*time.Second)
+	if len(upstream.sent) != 0 {
+		t.Fatalf("Nothing should be sent overnight, got %d notifications", len(upstream.sent))
+	}
+
+	// the job is still failing in the morning
+	clk.Set(time.Date(1970, 1, 1, 5, 59, 55, 0, time.UTC))
+	g.handleMessage(&Message{Host: "h", Service: "batch-import", State: stateCritical})
+	after(g, clk, 5*time.Second)
+	if len(upstream.sent) != 1 || upstream.sent[0].Message.State != stateCritical {
+		t.Errorf("Expected the CRITICAL once the night is over, got %d notifications", len(upstream.sent))
+	}
+}
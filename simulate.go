@@ -0,0 +1,247 @@
+package main
+
+/**
+ * File: simulate.go
+ *
+ * Implements the 'simulate' command. A recorded stream of check results is replayed through
+ * the real Gateway and Registry on a virtual clock, printing every notification that would have
+ * been sent upstream along with the reason for it. This is meant for tuning the config (TTLs,
+ * init buffer, flap threshold, policies, ...) against real traffic before changing production.
+ *
+ * The input is JSON lines, one check result per line, in the order they were received:
+ *
+ *    {"time": "2016-06-01T12:00:00Z", "host": "web1", "service": "api", "state": 2, "output": "..."}
+ *
+ * where state is the NSCA return code (0 = OK, 1 = WARNING, 2 = CRITICAL, 3 = UNKNOWN).
+ *
+ * The gateway is set up as nbad sets it up: the silences from the config and the silences file
+ * apply, and the decisions are written to the audit log (with the virtual times).
+ */
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/JohnMurray/nbad/clock"
+	"github.com/codegangsta/cli"
+)
+
+// SimulatedResult is a single recorded check result fed to the simulation
+type SimulatedResult struct {
+	Time    time.Time `json:"time"`
+	Host    string    `json:"host"`
+	Service string    `json:"service"`
+	State   uint16    `json:"state"`
+	Output  string    `json:"output"`
+}
+
+// simulationUpstream prints notifications instead of sending them anywhere
+type simulationUpstream struct {
+	out      io.Writer
+	clock    clock.Clock
+	byReason map[string]int
+}
+
+func (u *simulationUpstream) Send(n *Notification) error {
+	u.byReason[n.Reason]++
+	reason := n.Reason
+	if n.Route != "" {
+		reason += ", via " + n.Route
+	}
+	_, err := fmt.Fprintf(u.out, "%s  %-8s  %s/%s  (%s)  %s\n", u.clock.Now().UTC().Format(time.RFC3339),
+		stateName(n.Message.State), n.Message.Host, n.Message.Service, reason, n.Message.Message)
+	return err
+}
+
+func simulateCommand(configFile *string) cli.Command {
+	return cli.Command{
+		Name:      "simulate",
+		Usage:     "Replay recorded check results through the gateway and print the upstream decisions",
+		ArgsUsage: "[results.jsonl (default: stdin)]",
+		Flags: []cli.Flag{
+			cli.IntFlag{
+				Name:  "ttl",
+				Usage: "Override message_cache_ttl_in_seconds",
+			},
+			cli.IntFlag{
+				Name:  "init-buffer",
+				Usage: "Override message_init_buffer_ttl_in_seconds",
+			},
+			cli.IntFlag{
+				Name:  "flap-threshold",
+				Usage: "Override flap_count_threshold",
+			},
+		},
+		Action: func(c *cli.Context) {
+			logger := TempLogger("SIMULATE")
+			InitConfig(*configFile, logger)
+			if ttl := c.Int("ttl"); ttl > 0 {
+				Config().MessageCacheTTLInSeconds = uint(ttl)
+			}
+			if buffer := c.Int("init-buffer"); buffer > 0 {
+				Config().MessageInitBufferTimeSeconds = uint(buffer)
+			}
+			if threshold := c.Int("flap-threshold"); threshold > 0 {
+				Config().FlapCountThreshold = uint(threshold)
+			}
+			validateConfig(logger)
+
+			in := os.Stdin
+			if file := c.Args().First(); file != "" && file != "-" {
+				f, err := os.Open(file)
+				if err != nil {
+					logger.Fatalf("could not open '%s': %v\n", file, err)
+				}
+				defer f.Close()
+				in = f
+			}
+
+			if err := simulate(in, os.Stdout); err != nil {
+				logger.Fatalln(err)
+			}
+		},
+	}
+}
+
+// simulate - replays the results read from 'in' and writes the upstream decisions to 'out'
+func simulate(in io.Reader, out io.Writer) error {
+	clk := clock.NewFake(time.Unix(0, 0))
+	upstream := &simulationUpstream{out: out, clock: clk, byReason: make(map[string]int)}
+	var g *Gateway
+
+	scanner := bufio.NewScanner(in)
+	results := 0
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var r SimulatedResult
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+
+		if g == nil {
+			// the virtual clock starts with the recording
+			clk.Set(r.Time)
+			registry, err := newConfiguredRegistry(clk)
+			if err != nil {
+				return err
+			}
+			if g, err = newConfiguredGateway(registry, nil); err != nil {
+				return err
+			}
+			// the silences file belongs to the running nbad, silences ending in the recording
+			// must not be dropped from it
+			g.silences.path = ""
+			g.upstream = upstream
+		}
+		if r.Time.Before(clk.Now()) {
+			return fmt.Errorf("line %d: results must be in time order", line)
+		}
+
+		runUntil(g, clk, r.Time)
+		m := &Message{
+			Timestamp: uint32(r.Time.Unix()),
+			State:     r.State,
+			Host:      r.Host,
+			Service:   r.Service,
+			Message:   r.Output,
+		}
+		transform(m, clk.Now())
+		g.handleMessage(m)
+		results++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if g != nil {
+		// let everything still buffering, waiting to expire or to be summarized play out
+		after(g, clk, Config().settleTime())
+	}
+
+	fmt.Fprintf(out, "\n%d results replayed\n", results)
+	reasons := make([]string, 0, len(upstream.byReason))
+	for reason := range upstream.byReason {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fmt.Fprintf(out, "%6d  %s\n", upstream.byReason[reason], reason)
+	}
+	return nil
+}
+
+// settleTime returns how long it takes at most for the last result to play out: to be sent
+// after buffering and a recovery hold, to expire or go stale, and then to be summarized by a
+// digest or the end of a storm
+func (c *NbadConfig) settleTime() time.Duration {
+	var longest uint
+	consider := func(ttl uint, buffer uint, hold uint, freshness uint) {
+		if buffer+hold+ttl > longest {
+			longest = buffer + hold + ttl
+		}
+		if freshness > longest {
+			longest = freshness
+		}
+	}
+	consider(c.MessageCacheTTLInSeconds, c.MessageInitBufferTimeSeconds, c.RecoveryHoldInSeconds,
+		c.FreshnessThresholdInSeconds)
+	for _, p := range c.Policies {
+		ttl, buffer, hold, freshness := c.MessageCacheTTLInSeconds, c.MessageInitBufferTimeSeconds,
+			c.RecoveryHoldInSeconds, c.FreshnessThresholdInSeconds
+		if p.MessageCacheTTLInSeconds != nil {
+			ttl = *p.MessageCacheTTLInSeconds
+		}
+		if p.MessageInitBufferTimeSeconds != nil {
+			buffer = *p.MessageInitBufferTimeSeconds
+		}
+		if p.RecoveryHoldInSeconds != nil {
+			hold = *p.RecoveryHoldInSeconds
+		}
+		if p.FreshnessThresholdInSeconds != nil {
+			freshness = *p.FreshnessThresholdInSeconds
+		}
+		consider(ttl, buffer, hold, freshness)
+	}
+
+	var summary uint
+	for _, d := range c.Digests {
+		if d.IntervalInSeconds > summary {
+			summary = d.IntervalInSeconds
+		}
+	}
+	for _, s := range c.Storms {
+		if s.WindowInSeconds+s.CalmInSeconds > summary {
+			summary = s.WindowInSeconds + s.CalmInSeconds
+		}
+	}
+	return time.Duration(longest+summary)*time.Second + maxWakeInterval
+}
+
+// after - moves the virtual clock forward by d and lets the gateway handle whatever is due then
+func after(g *Gateway, clk *clock.Fake, d time.Duration) {
+	runUntil(g, clk, clk.Now().Add(d))
+	g.tick()
+}
+
+// runUntil - moves the virtual clock forward to 'until', waking the gateway up on the way
+// whenever it would wake up in production
+func runUntil(g *Gateway, clk *clock.Fake, until time.Time) {
+	for {
+		at := g.nextWakeup()
+		if at.After(until) {
+			break
+		}
+		if at.After(clk.Now()) {
+			clk.Set(at)
+		}
+		g.tick()
+	}
+	clk.Set(until)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSimulateReplaysThroughGateway(t *testing.T) {
+	useTestConfig(t, &NbadConfig{
+		FlapCountThreshold:           5,
+		MessageInitBufferTimeSeconds: 10,
+		MessageCacheTTLInSeconds:     60,
+	})
+
+	// a transient CRITICAL that clears within the init buffer, then a real one that expires
+	in := strings.NewReader(`
+{"time": "2016-06-01T12:00:00Z", "host": "web1", "service": "api", "state": 0, "output": "fine"}
+{"time": "2016-06-01T12:00:20Z", "host": "web1", "service": "api", "state": 2, "output": "blip"}
+{"time": "2016-06-01T12:00:25Z", "host": "web1", "service": "api", "state": 0, "output": "fine"}
+{"time": "2016-06-01T12:01:00Z", "host": "web1", "service": "db", "state": 2, "output": "down"}
+`)
+	var out bytes.Buffer
+	if err := simulate(in, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(out.String(), "\n")
+	expected := []string{
+		"2016-06-01T12:00:10Z  OK        web1/api  (new service)  fine",
+		"2016-06-01T12:01:10Z  CRITICAL  web1/db  (new service)  down",
+		"2016-06-01T12:02:00Z  OK        web1/db  (state expired, expiry action 'ok')  " +
+			synthesizedPrefix + "no check result received in 1m0s, last state was CRITICAL",
+		"",
+		"4 results replayed",
+	}
+	for i, line := range expected {
+		if i >= len(lines) || lines[i] != line {
+			t.Fatalf("Unexpected simulation output, wanted line %d to be\n%s\ngot:\n%s", i, line, out.String())
+		}
+	}
+}
+
+func TestSimulateRejectsOutOfOrderResults(t *testing.T) {
+	useTestConfig(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10, MessageCacheTTLInSeconds: 60})
+	in := strings.NewReader(`{"time": "2016-06-01T12:00:10Z", "host": "h", "service": "s", "state": 0}
+{"time": "2016-06-01T12:00:00Z", "host": "h", "service": "s", "state": 0}`)
+
+	if err := simulate(in, &bytes.Buffer{}); err == nil {
+		t.Errorf("Expected results out of time order to be rejected")
+	}
+}
+
+func TestSimulateEndsWithDigests(t *testing.T) {
+	useTestConfig(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10, MessageCacheTTLInSeconds: 60,
+		Digests:  []*Digest{{Name: "warnings", IntervalInSeconds: 45}},
+		Policies: []*Policy{{Service: "disk", Digest: "warnings"}}})
+	in := strings.NewReader(`{"time": "2016-06-01T12:00:00Z", "host": "web1", "service": "disk", "state": 1, "output": "full"}`)
+
+	// the digest keeps being due, the simulation ends once the last result has played out
+	var out bytes.Buffer
+	if err := simulate(in, &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := "2016-06-01T12:00:45Z  WARNING   nbad/digest warnings  (digest interval)  " +
+		synthesizedPrefix + "1 results for 1 services in the last 45s: web1/disk WARNING x1\n" +
+		"2016-06-01T12:01:30Z  OK        nbad/digest warnings  (digest interval)  " +
+		synthesizedPrefix + "1 results for 1 services in the last 45s: web1/disk OK x1\n\n1 results replayed\n"
+	if !strings.HasPrefix(out.String(), expected) {
+		t.Errorf("Expected the digest to play out after the last result, got:\n%s", out.String())
+	}
+}
+
+func TestSimulateEndsWithRollupsAndDigests(t *testing.T) {
+	useTestConfig(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10, MessageCacheTTLInSeconds: 60,
+		Rollups:  []*Rollup{{Name: "api", Service: "api", CriticalPercent: 50}, {Name: "db", Service: "db", CriticalPercent: 50}},
+		Digests:  []*Digest{{Name: "warnings", IntervalInSeconds: 45}},
+		Policies: []*Policy{{Service: "disk", Digest: "warnings"}}})
+	in := strings.NewReader(`{"time": "2016-06-01T12:00:00Z", "host": "web1", "service": "api", "state": 2, "output": "down"}
+{"time": "2016-06-01T12:00:00Z", "host": "web1", "service": "disk", "state": 1, "output": "full"}`)
+
+	// the rollups keep being computed (one of them never has members), the simulation has to end anyway
+	var out bytes.Buffer
+	if err := simulate(in, &out); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"2016-06-01T12:00:01Z  CRITICAL  nbad/api  (rollup changed)  " + synthesizedPrefix + "1 members, 1 CRITICAL (100%): web1/api",
+		"2016-06-01T12:00:10Z  CRITICAL  web1/api  (new service)  down",
+		"2016-06-01T12:00:45Z  WARNING   nbad/digest warnings  (digest interval)  " +
+			synthesizedPrefix + "1 results for 1 services in the last 45s: web1/disk WARNING x1",
+		"2016-06-01T12:01:00Z  OK        web1/api  (state expired, expiry action 'ok')  " +
+			synthesizedPrefix + "no check result received in 1m0s, last state was CRITICAL",
+		"2016-06-01T12:01:00Z  UNKNOWN   nbad/api  (rollup changed)  " + synthesizedPrefix + "no members reporting",
+		"2016-06-01T12:01:30Z  OK        nbad/digest warnings  (digest interval)  " +
+			synthesizedPrefix + "1 results for 1 services in the last 45s: web1/disk OK x1",
+		"",
+		"2 results replayed",
+	}
+	if lines := strings.Split(out.String(), "\n"); len(lines) < len(expected) ||
+		strings.Join(lines[:len(expected)], "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Expected the rollups and the digest to play out after the last result, got:\n%s", out.String())
+	}
+}
+
+func TestSimulateAppliesConfigSilences(t *testing.T) {
+	start := time.Date(2016, 6, 1, 12, 0, 0, 0, time.UTC)
+	useTestConfig(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10, MessageCacheTTLInSeconds: 600,
+		Silences: []*Silence{{Host: "web1", Author: "ops", Start: start, End: start.Add(5 * time.Minute)}}})
+	in := strings.NewReader(`{"time": "2016-06-01T12:00:00Z", "host": "web1", "service": "api", "state": 2, "output": "down"}`)
+
+	var out bytes.Buffer
+	if err := simulate(in, &out); err != nil {
+		t.Fatal(err)
+	}
+	// the CRITICAL is held until the silence from the config ends
+	expected := "2016-06-01T12:05:00Z  CRITICAL  web1/api  (silence ended, new service)  down\n"
+	if !strings.HasPrefix(out.String(), expected) {
+		t.Errorf("Expected the silence to hold the CRITICAL, got:\n%s", out.String())
+	}
+}
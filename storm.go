@@ -0,0 +1,270 @@
+package main
+
+/**
+ * File: storm.go
+ *
+ * When something big breaks, many services fail at once and each of them pages. A storm
+ * detector counts the non-OK results the gateway sends for a group of services (all of them by
+ * default) in a sliding window. Once the count reaches the threshold, nbad is in storm mode
+ * for the group:
+ *
+ *   - one digest result is sent, listing the services that went non-OK
+ *   - everything the gateway would send for the group is held (see hold.go)
+ *
+ * The storm is over once the count has stayed below the threshold for the calm period. An OK
+ * digest result is sent, and the held results are released, which sends the final state of
+ * every service upstream does not already have.
+ */
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/JohnMurray/nbad/timewindow"
+)
+
+const (
+	defaultStormWindowInSeconds = 60
+
+	// maxListedServices - the most services listed in the output of a result nbad makes up
+	maxListedServices = 20
+)
+
+// Storm is a storm detector for the services matching Host and Service (globs)
+type Storm struct {
+	// Name - identifies the storm detector in logs and the default digest service
+	Name string `json:"name"`
+
+	// Host - glob pattern matched against the host name (empty matches all)
+	Host string `json:"host"`
+
+	// Service - glob pattern matched against the service name (empty matches all)
+	Service string `json:"service"`
+
+	// Threshold - the number of non-OK results within the window that starts a storm
+	Threshold uint `json:"threshold"`
+
+	// WindowInSeconds - the size of the sliding window (default 60)
+	WindowInSeconds uint `json:"window_in_seconds"`
+
+	// CalmInSeconds - how long the count has to stay below the threshold for the storm to end
+	// (default is the size of the window)
+	CalmInSeconds uint `json:"calm_in_seconds"`
+
+	// DigestHost - host the digest result is sent for (default "nbad")
+	DigestHost string `json:"digest_host"`
+
+	// DigestService - service the digest result is sent for (default "storm <name>")
+	DigestService string `json:"digest_service"`
+
+	hostRegex    *regexp.Regexp
+	serviceRegex *regexp.Regexp
+}
+
+// String describes the storm detector, for log and error messages
+func (s *Storm) String() string {
+	return fmt.Sprintf("storm '%s'", s.Name)
+}
+
+// matches returns true if the entry belongs to the group. The services nbad sends results for
+// itself (digests, rollups, host up / down) never do.
+func (s *Storm) matches(entry *MessageEntry) bool {
+	if entry.owned {
+		return false
+	}
+	return matchName(entry.host, s.hostRegex) && matchName(entry.service, s.serviceRegex)
+}
+
+func (s *Storm) compile() error {
+	if s.Name == "" {
+		return fmt.Errorf("storm '%s/%s': needs a name", s.Host, s.Service)
+	}
+	var err error
+	if s.hostRegex, err = compileMatcher("host", s.Host, ""); err != nil {
+		return fmt.Errorf("%s: %v", s, err)
+	}
+	if s.serviceRegex, err = compileMatcher("service", s.Service, ""); err != nil {
+		return fmt.Errorf("%s: %v", s, err)
+	}
+	if s.Threshold == 0 {
+		return fmt.Errorf("%s: needs a threshold", s)
+	}
+	if s.WindowInSeconds == 0 {
+		s.WindowInSeconds = defaultStormWindowInSeconds
+	}
+	if s.CalmInSeconds == 0 {
+		s.CalmInSeconds = s.WindowInSeconds
+	}
+	if s.DigestHost == "" {
+		s.DigestHost = nbadHost
+	}
+	if s.DigestService == "" {
+		s.DigestService = "storm " + s.Name
+	}
+	return nil
+}
+
+// compileStorms validates the storm detectors and fills in their defaults
+func (c *NbadConfig) compileStorms() error {
+	names := nameSet{}
+	for _, s := range c.Storms {
+		if err := s.compile(); err != nil {
+			return err
+		}
+		if err := names.add(s.Name, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// stormState is what the gateway tracks for a storm detector
+type stormState struct {
+	*Storm
+
+	// window - non-OK results sent for the group, by second
+	window *timewindow.Window
+	// recent - when each service of the group last went non-OK, within the window
+	recent map[string]time.Time
+
+	active bool
+	since  time.Time
+	// stormyAt - the last time the count was at or above the threshold
+	stormyAt time.Time
+	// affected - services that went non-OK since the storm started
+	affected map[string]bool
+}
+
+func newStormStates(storms []*Storm, now time.Time) []*stormState {
+	states := make([]*stormState, 0, len(storms))
+	for _, s := range storms {
+		states = append(states, &stormState{
+			Storm:  s,
+			window: timewindow.New(now.Unix(), int(s.WindowInSeconds)),
+			recent: make(map[string]time.Time),
+		})
+	}
+	return states
+}
+
+// advanceWindow moves the window of size seconds up to now. A window with nothing left in it
+// is replaced rather than walking through all the seconds since.
+func advanceWindow(w *timewindow.Window, size uint, now time.Time) *timewindow.Window {
+	if now.Unix()-w.Epoch() >= int64(size) {
+		return timewindow.New(now.Unix(), int(size))
+	}
+	w.Add(now.Unix(), 0)
+	return w
+}
+
+// slide moves the window up to now and forgets the services that went non-OK before it
+func (s *stormState) slide(now time.Time) {
+	s.window = advanceWindow(s.window, s.WindowInSeconds, now)
+	windowStart := now.Add(-time.Duration(s.WindowInSeconds) * time.Second)
+	for key, at := range s.recent {
+		if !at.After(windowStart) {
+			delete(s.recent, key)
+		}
+	}
+}
+
+// countsTowardStorm returns true if the decisions recorded under the rule are new results
+// rather than held ones being released or nbad's own summaries
+func countsTowardStorm(rule string) bool {
+	switch rule {
+	case ruleForwarded, ruleFlap, ruleExpiry, ruleFreshness:
+		return true
+	}
+	return false
+}
+
+// noteStormResult - counts a non-OK result about to be sent for the entry, which may start a storm
+func (g *Gateway) noteStormResult(rule string, entry *MessageEntry, n *Notification, now time.Time) {
+	if n.Message.State == stateOk || !countsTowardStorm(rule) {
+		return
+	}
+	key := registryKey(entry.host, entry.service)
+	for _, s := range g.storms {
+		if !s.matches(entry) {
+			continue
+		}
+		s.slide(now)
+		s.window.Add(now.Unix(), 1)
+		s.recent[key] = now
+		if s.active {
+			s.affected[key] = true
+		} else if uint(s.window.Total()) >= s.Threshold {
+			g.startStorm(s, now)
+		}
+	}
+}
+
+// stormHold returns the hold for an entry whose group is in a storm, nil if there is none
+func (g *Gateway) stormHold(entry *MessageEntry) *hold {
+	for _, s := range g.storms {
+		if s.active && s.matches(entry) {
+			return &hold{by: s.String(), rule: ruleStormSubsided, reason: "storm subsided"}
+		}
+	}
+	return nil
+}
+
+// updateStorms - ends the storms that have calmed down
+func (g *Gateway) updateStorms(now time.Time) {
+	for _, s := range g.storms {
+		s.slide(now)
+		if uint(s.window.Total()) >= s.Threshold {
+			s.stormyAt = now
+		} else if s.active && now.Sub(s.stormyAt) >= time.Duration(s.CalmInSeconds)*time.Second {
+			g.endStorm(s, now)
+		}
+	}
+}
+
+func (g *Gateway) startStorm(s *stormState, now time.Time) {
+	s.active, s.since, s.stormyAt = true, now, now
+	s.affected = make(map[string]bool, len(s.recent))
+	for key := range s.recent {
+		s.affected[key] = true
+	}
+	Logger().Warning.Printf("%s started, %d non-OK results within %ds, holding alerts\n",
+		s, s.window.Total(), s.WindowInSeconds)
+	output := fmt.Sprintf("alert storm, %d services went non-OK within %ds, their alerts are held until it subsides: %s",
+		len(s.affected), s.WindowInSeconds, listServices(s.affected))
+	g.sendStormDigest(s, stateCritical, output, now)
+}
+
+func (g *Gateway) endStorm(s *stormState, now time.Time) {
+	s.active = false
+	Logger().Info.Printf("%s is over after %v, releasing held alerts\n", s, now.Sub(s.since))
+	output := fmt.Sprintf("alert storm over after %v, %d services were affected, their final states are sent: %s",
+		now.Sub(s.since), len(s.affected), listServices(s.affected))
+	s.affected = nil
+	g.sendStormDigest(s, stateOk, output, now)
+}
+
+func (g *Gateway) sendStormDigest(s *stormState, state uint16, output string, now time.Time) {
+	from := &Message{Host: s.DigestHost, Service: s.DigestService}
+	g.decision(ruleStormDigest, g.registry.own(s.DigestHost, s.DigestService), nil, &Notification{
+		Message:     newSynthesizedMessage(from, state, output, uint32(now.Unix())),
+		Reason:      "storm digest",
+		Synthesized: true,
+	})
+}
+
+// listServices lists the services (by registry key) for a digest result, in order
+func listServices(keys map[string]bool) string {
+	names := make([]string, 0, len(keys))
+	for key := range keys {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	if len(names) <= maxListedServices {
+		return strings.Join(names, ", ")
+	}
+	return fmt.Sprintf("%s and %d more", strings.Join(names[:maxListedServices], ", "),
+		len(names)-maxListedServices)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStormHoldsAlertsAndReconcilesWhenItSubsides(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		Storms: []*Storm{{Name: "apps", Service: "app*", Threshold: 3, WindowInSeconds: 20, CalmInSeconds: 10}}})
+	for i := 1; i <= 5; i++ {
+		g.handleMessage(&Message{Host: "h", Service: fmt.Sprintf("app%d", i), State: stateOk})
+	}
+	after(g, clk, 10*time.Second)
+	upstream.sent = nil
+
+	// app1 goes first, so it is one of the alerts sent before the storm
+	g.handleMessage(&Message{Host: "h", Service: "app1", State: stateCritical})
+	after(g, clk, time.Second)
+	for i := 2; i <= 5; i++ {
+		g.handleMessage(&Message{Host: "h", Service: fmt.Sprintf("app%d", i), State: stateCritical})
+	}
+	after(g, clk, 10*time.Second)
+
+	var digest *Notification
+	before := 0
+	for _, n := range upstream.sent {
+		if n.Message.Service == "storm apps" {
+			digest = n
+		} else if digest == nil {
+			before++
+		} else {
+			t.Errorf("Nothing should be sent for %s during the storm", n.Message.Service)
+		}
+	}
+	if before != 2 {
+		t.Errorf("Expected the 2 alerts before the threshold to be sent, got %d", before)
+	}
+	if digest == nil || digest.Message.Host != "nbad" || digest.Message.State != stateCritical ||
+		!strings.Contains(digest.Message.Message, "3 services went non-OK") {
+		t.Fatalf("Expected a CRITICAL storm digest, got %v", digest)
+	}
+
+	// one of them recovers during the storm, the rest stay down
+	g.handleMessage(&Message{Host: "h", Service: "app1", State: stateOk})
+	after(g, clk, 10*time.Second)
+	g.handleMessage(&Message{Host: "h", Service: "app1", State: stateOk})
+	after(g, clk, 5*time.Second)
+	if !g.storms[0].active {
+		t.Fatalf("The storm should still be going on")
+	}
+	upstream.sent = upstream.sent[:0]
+	after(g, clk, 30*time.Second)
+
+	if g.storms[0].active {
+		t.Fatalf("The storm should be over")
+	}
+	sent := map[string]uint16{}
+	for _, n := range upstream.sent {
+		if _, ok := sent[n.Message.Service]; ok {
+			t.Errorf("Expected a single result for %s", n.Message.Service)
+		}
+		sent[n.Message.Service] = n.Message.State
+	}
+	if state, ok := sent["storm apps"]; !ok || state != stateOk {
+		t.Errorf("Expected an OK storm digest once the storm is over")
+	}
+	if len(sent) != 5 {
+		t.Errorf("Expected the digest, app1's recovery and the 3 alerts held, got %v", sent)
+	}
+	for service, state := range sent {
+		entry := g.registry.getEntry(registryKey("h", service))
+		if entry != nil && entry.message.State != state {
+			t.Errorf("Expected the final state of %s to be sent, got %s", service, stateName(state))
+		}
+	}
+}
+
+func TestStormNeedsThreshold(t *testing.T) {
+	c := &NbadConfig{Storms: []*Storm{{Name: "all"}}}
+	if err := c.compile(); err == nil {
+		t.Errorf("Expected a storm without a threshold to be rejected")
+	}
+}
+
+func TestOverlappingStormsDoNotHoldEachOthersDigests(t *testing.T) {
+	g, upstream, clk := newTestGateway(t, &NbadConfig{FlapCountThreshold: 5, MessageInitBufferTimeSeconds: 10,
+		Storms: []*Storm{
+			{Name: "all", Threshold: 2, WindowInSeconds: 60},
+			{Name: "apps", Service: "app*", Threshold: 3, WindowInSeconds: 60},
+		}})
+	g.handleMessage(&Message{Host: "h", Service: "db1", State: stateCritical})
+	g.handleMessage(&Message{Host: "h", Service: "db2", State: stateCritical})
+	after(g, clk, 10*time.Second)
+	if !g.storms[0].active {
+		t.Fatalf("The storm over all services should have started")
+	}
+
+	// the apps go down during the storm over all services, which holds their alerts but not the
+	// digest of the apps' own storm
+	for i := 1; i <= 3; i++ {
+		g.handleMessage(&Message{Host: "h", Service: fmt.Sprintf("app%d", i), State: stateCritical})
+	}
+	after(g, clk, 10*time.Second)
+	if !g.storms[1].active {
+		t.Fatalf("The storm over the apps should have started")
+	}
+	digests := map[string]uint16{}
+	for _, n := range upstream.sent {
+		if strings.HasPrefix(n.Message.Service, "storm ") {
+			digests[n.Message.Service] = n.Message.State
+		} else if strings.HasPrefix(n.Message.Service, "app") {
+			t.Errorf("Nothing should be sent for %s during the storms", n.Message.Service)
+		}
+	}
+	if len(digests) != 2 || digests["storm all"] != stateCritical || digests["storm apps"] != stateCritical {
+		t.Errorf("Expected the digests of both storms to be sent, got %v", digests)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+/**
+ * File: threshold.go
+ *
+ * Thresholds compiled into plugins are hard to change once they are deployed on hundreds of
+ * hosts. A policy's 'thresholds' override them: each matches perfdata labels (with a glob
+ * pattern or a regular expression, all labels if left out) and has warning and critical
+ * ranges in the syntax of the Nagios plugin guidelines (e.g. '90', '~:5' or '@10:20', see the
+ * perfdata package). When any of them matches a perfdata value of a result, the state of the
+ * result is recomputed from the thresholds alone:
+ *
+ *   - CRITICAL if a matching value is in alert for its critical range
+ *   - WARNING if a matching value is in alert for its warning range
+ *   - OK otherwise
+ *
+ * Results without matching (known) values keep their state. Thresholds apply as part of the
+ * transform stage (see transform.go), after the state map, so the recomputed state goes through
+ * the gateway like any other.
+ */
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/JohnMurray/nbad/perfdata"
+)
+
+// Threshold sets the warning and critical ranges of the perfdata values it matches
+type Threshold struct {
+	// Label - glob pattern matched against the perfdata label
+	Label string `json:"label"`
+
+	// LabelRegex - regular expression matched against the perfdata label
+	LabelRegex string `json:"label_regex"`
+
+	// Warning - range the value has to stay in (or out of, with '@') not to be WARNING
+	Warning string `json:"warning"`
+
+	// Critical - range the value has to stay in (or out of, with '@') not to be CRITICAL
+	Critical string `json:"critical"`
+
+	labelRegex *regexp.Regexp
+	warning    *perfdata.Range
+	critical   *perfdata.Range
+}
+
+// String describes the threshold, for log and error messages
+func (t *Threshold) String() string {
+	label := t.Label
+	if t.LabelRegex != "" {
+		label = "/" + t.LabelRegex + "/"
+	}
+	return fmt.Sprintf("threshold '%s' (warning '%s', critical '%s')", label, t.Warning, t.Critical)
+}
+
+func (t *Threshold) compile() error {
+	var err error
+	if t.labelRegex, err = compileMatcher("label", t.Label, t.LabelRegex); err != nil {
+		return fmt.Errorf("%s: %v", t, err)
+	}
+	if t.Warning == "" && t.Critical == "" {
+		return fmt.Errorf("%s: needs a warning or a critical range", t)
+	}
+	if t.Warning != "" {
+		if t.warning, err = perfdata.ParseRange(t.Warning); err != nil {
+			return fmt.Errorf("%s: %v", t, err)
+		}
+	}
+	if t.Critical != "" {
+		if t.critical, err = perfdata.ParseRange(t.Critical); err != nil {
+			return fmt.Errorf("%s: %v", t, err)
+		}
+	}
+	return nil
+}
+
+// matches returns true if the threshold applies to the perfdata value
+func (t *Threshold) matches(v *perfdata.Value) bool {
+	if v.Unknown {
+		return false
+	}
+	return matchName(v.Label, t.labelRegex)
+}
+
+// state returns the state of the value, stateOk if it is in neither range
+func (t *Threshold) state(v *perfdata.Value) uint16 {
+	if t.critical != nil && t.critical.Alert(v.Value) {
+		return stateCritical
+	}
+	if t.warning != nil && t.warning.Alert(v.Value) {
+		return stateWarning
+	}
+	return stateOk
+}
+
+// thresholdState returns the state of the message according to the thresholds of the policy,
+// false if none of them matches any of its perfdata values
+func thresholdState(m *Message, p *Policy) (uint16, bool) {
+	var state uint16 = stateOk
+	matched := false
+	values := m.parsed().Perfdata
+	for i := range values {
+		v := &values[i]
+		for _, t := range p.Thresholds {
+			if !t.matches(v) {
+				continue
+			}
+			matched = true
+			if s := t.state(v); severity(s) > severity(state) {
+				state = s
+			}
+			// the first matching threshold applies to a value
+			break
+		}
+	}
+	return state, matched
+}
+
+// applyThresholds - recomputes the state of the message from the thresholds of the policy
+func applyThresholds(m *Message, p *Policy) {
+	state, ok := thresholdState(m, p)
+	if !ok || state == m.State {
+		return
+	}
+	Logger().Trace.Printf("thresholds change state '%s' of service '%s' to '%s'\n",
+		stateName(m.State), m.Service, stateName(state))
+	if !m.Remapped {
+		m.OriginalState, m.Remapped = m.State, true
+	}
+	m.State = state
+	m.Remapped = m.State != m.OriginalState
+}
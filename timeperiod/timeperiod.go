@@ -0,0 +1,232 @@
+// Package timeperiod provides recurring, Nagios-like time periods
+/*
+
+A time period is defined by the times of day it covers on each day of the week, in a
+given time zone, minus the times covered by the periods it excludes:
+
+	"business-hours": {
+		"timezone": "Europe/Berlin",
+		"ranges":   { "monday-friday": "09:00-17:00" },
+		"exclude":  [ "lunch" ]
+	},
+	"lunch": {
+		"ranges": { "monday-friday": "12:00-13:00" }
+	}
+
+Days are weekday names, ranges of weekdays (which may wrap around, e.g. "friday-monday")
+or "all". Each day maps to a comma separated list of HH:MM-HH:MM ranges, where the end
+of a range is exclusive and may be 24:00. Periods without a time zone use UTC.
+
+Definitions are compiled all at once, since periods refer to each other by name. Periods
+are safe to be used from multiple goroutines once compiled.
+
+*/
+package timeperiod
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Definition is a time period as written in the config file
+type Definition struct {
+	// TimeZone - IANA name of the time zone the ranges are in (UTC if empty)
+	TimeZone string `json:"timezone"`
+
+	// Ranges - the times of day covered, by day of the week
+	Ranges map[string]string `json:"ranges"`
+
+	// Exclude - names of the periods whose times are not covered by this one
+	Exclude []string `json:"exclude"`
+}
+
+// Period is a compiled time period
+type Period struct {
+	name     string
+	location *time.Location
+	days     [7][]span
+	exclude  []*Period
+}
+
+// span is a range of seconds since midnight, end exclusive
+type span struct {
+	from, to int
+}
+
+// Name returns the name the period was defined under
+func (p *Period) Name() string {
+	return p.name
+}
+
+// Contains returns true if the time falls in the period
+func (p *Period) Contains(t time.Time) bool {
+	t = t.In(p.location)
+	second := t.Hour()*3600 + t.Minute()*60 + t.Second()
+	covered := false
+	for _, s := range p.days[t.Weekday()] {
+		if second >= s.from && second < s.to {
+			covered = true
+			break
+		}
+	}
+	if !covered {
+		return false
+	}
+	for _, e := range p.exclude {
+		if e.Contains(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// Compile parses the definitions and resolves their exclusions
+func Compile(definitions map[string]*Definition) (map[string]*Period, error) {
+	periods := make(map[string]*Period, len(definitions))
+	for name, def := range definitions {
+		p, err := parse(name, def)
+		if err != nil {
+			return nil, err
+		}
+		periods[name] = p
+	}
+
+	for name, def := range definitions {
+		for _, excluded := range def.Exclude {
+			e, ok := periods[excluded]
+			if !ok {
+				return nil, fmt.Errorf("time period '%s': excludes unknown period '%s'", name, excluded)
+			}
+			periods[name].exclude = append(periods[name].exclude, e)
+		}
+	}
+
+	// a period excluding itself (even indirectly) would never finish checking
+	for name, p := range periods {
+		if cyclic(p, map[*Period]bool{}) {
+			return nil, fmt.Errorf("time period '%s': exclusions form a cycle", name)
+		}
+	}
+	return periods, nil
+}
+
+func cyclic(p *Period, visiting map[*Period]bool) bool {
+	if visiting[p] {
+		return true
+	}
+	visiting[p] = true
+	for _, e := range p.exclude {
+		if cyclic(e, visiting) {
+			return true
+		}
+	}
+	delete(visiting, p)
+	return false
+}
+
+func parse(name string, def *Definition) (*Period, error) {
+	p := &Period{name: name, location: time.UTC}
+	if def.TimeZone != "" {
+		location, err := time.LoadLocation(def.TimeZone)
+		if err != nil {
+			return nil, fmt.Errorf("time period '%s': %v", name, err)
+		}
+		p.location = location
+	}
+
+	for dayspec, rangespec := range def.Ranges {
+		days, err := parseDays(dayspec)
+		if err != nil {
+			return nil, fmt.Errorf("time period '%s': %v", name, err)
+		}
+		spans, err := parseSpans(rangespec)
+		if err != nil {
+			return nil, fmt.Errorf("time period '%s': %v", name, err)
+		}
+		for _, day := range days {
+			p.days[day] = append(p.days[day], spans...)
+		}
+	}
+	return p, nil
+}
+
+var weekdays = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// parseDays parses "monday", "monday-friday" or "all"
+func parseDays(spec string) ([]time.Weekday, error) {
+	spec = strings.ToLower(strings.TrimSpace(spec))
+	if spec == "all" {
+		return []time.Weekday{time.Sunday, time.Monday, time.Tuesday, time.Wednesday,
+			time.Thursday, time.Friday, time.Saturday}, nil
+	}
+
+	parts := strings.SplitN(spec, "-", 2)
+	from, ok := weekdays[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("unknown day '%s'", parts[0])
+	}
+	to := from
+	if len(parts) == 2 {
+		if to, ok = weekdays[parts[1]]; !ok {
+			return nil, fmt.Errorf("unknown day '%s'", parts[1])
+		}
+	}
+
+	days := []time.Weekday{from}
+	for day := from; day != to; {
+		day = (day + 1) % 7
+		days = append(days, day)
+	}
+	return days, nil
+}
+
+// parseSpans parses "09:00-12:00,13:00-17:00"
+func parseSpans(spec string) ([]span, error) {
+	var spans []span
+	for _, r := range strings.Split(spec, ",") {
+		parts := strings.Split(strings.TrimSpace(r), "-")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid time range '%s'", r)
+		}
+		from, err := parseTimeOfDay(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseTimeOfDay(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if from >= to {
+			return nil, fmt.Errorf("invalid time range '%s', it has to end after it starts", r)
+		}
+		spans = append(spans, span{from: from, to: to})
+	}
+	return spans, nil
+}
+
+// parseTimeOfDay parses "HH:MM" into seconds since midnight
+func parseTimeOfDay(s string) (int, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid time of day '%s'", s)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("invalid time of day '%s'", s)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("invalid time of day '%s'", s)
+	}
+	return hours*3600 + minutes*60, nil
+}
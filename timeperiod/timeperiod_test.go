@@ -0,0 +1,103 @@
+package timeperiod
+
+import (
+	"testing"
+	"time"
+)
+
+// 2026-10-19 is a Monday
+func at(day int, hour int, minute int) time.Time {
+	return time.Date(2026, 10, 19+day, hour, minute, 0, 0, time.UTC)
+}
+
+func compileOne(t *testing.T, defs map[string]*Definition, name string) *Period {
+	periods, err := Compile(defs)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return periods[name]
+}
+
+func TestWeekdayAndTimeRanges(t *testing.T) {
+	p := compileOne(t, map[string]*Definition{
+		"work": {Ranges: map[string]string{"monday-friday": "09:00-12:00, 13:00-17:00", "saturday": "10:00-11:00"}},
+	}, "work")
+
+	tests := []struct {
+		t        time.Time
+		expected bool
+	}{
+		{at(0, 9, 0), true},
+		{at(0, 8, 59), false},
+		{at(0, 12, 30), false},
+		{at(4, 16, 59), true},
+		{at(4, 17, 0), false},
+		{at(5, 10, 30), true},
+		{at(6, 10, 30), false},
+	}
+	for _, tt := range tests {
+		if p.Contains(tt.t) != tt.expected {
+			t.Errorf("%s %s: expected %v", tt.t.Weekday(), tt.t.Format("15:04"), tt.expected)
+		}
+	}
+}
+
+func TestWrappingDayRangeAndAll(t *testing.T) {
+	periods, err := Compile(map[string]*Definition{
+		"weekend": {Ranges: map[string]string{"saturday-sunday": "00:00-24:00"}},
+		"always":  {Ranges: map[string]string{"all": "00:00-24:00"}},
+		"late":    {Ranges: map[string]string{"friday-monday": "23:00-24:00"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !periods["weekend"].Contains(at(6, 23, 59)) || periods["weekend"].Contains(at(0, 0, 0)) {
+		t.Errorf("Expected the weekend to cover Sunday but not Monday")
+	}
+	if !periods["always"].Contains(at(2, 3, 0)) {
+		t.Errorf("Expected 'all' to cover every day")
+	}
+	if !periods["late"].Contains(at(0, 23, 30)) || periods["late"].Contains(at(1, 23, 30)) {
+		t.Errorf("Expected friday-monday to wrap over the weekend")
+	}
+}
+
+func TestExclusions(t *testing.T) {
+	p := compileOne(t, map[string]*Definition{
+		"work":  {Ranges: map[string]string{"monday-friday": "09:00-17:00"}, Exclude: []string{"lunch"}},
+		"lunch": {Ranges: map[string]string{"all": "12:00-13:00"}},
+	}, "work")
+	if p.Contains(at(0, 12, 15)) || !p.Contains(at(0, 13, 0)) {
+		t.Errorf("Expected lunch to be excluded from work")
+	}
+}
+
+func TestTimeZone(t *testing.T) {
+	if _, err := time.LoadLocation("America/New_York"); err != nil {
+		t.Skip("no time zone data available")
+	}
+	p := compileOne(t, map[string]*Definition{
+		"ny": {TimeZone: "America/New_York", Ranges: map[string]string{"monday": "09:00-10:00"}},
+	}, "ny")
+	// 13:30 UTC is 09:30 in New York (EDT)
+	if !p.Contains(at(0, 13, 30)) || p.Contains(at(0, 9, 30)) {
+		t.Errorf("Expected the ranges to be in New York time")
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []map[string]*Definition{
+		{"p": {Ranges: map[string]string{"funday": "09:00-10:00"}}},
+		{"p": {Ranges: map[string]string{"monday": "10:00-09:00"}}},
+		{"p": {Ranges: map[string]string{"monday": "09:00-25:00"}}},
+		{"p": {Ranges: map[string]string{"monday": "9-10"}}},
+		{"p": {TimeZone: "Nowhere/Special"}},
+		{"p": {Exclude: []string{"missing"}}},
+		{"a": {Exclude: []string{"b"}}, "b": {Exclude: []string{"a"}}},
+	}
+	for i, defs := range tests {
+		if _, err := Compile(defs); err == nil {
+			t.Errorf("Expected definition %d to be rejected", i)
+		}
+	}
+}
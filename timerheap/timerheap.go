@@ -0,0 +1,112 @@
+// Package timerheap keeps a set of keyed deadlines ordered so the earliest is always on top
+/*
+
+A Heap holds at most one deadline per key. Scheduling a key that is already in the
+heap moves its deadline rather than adding a second one, which makes it a good fit
+for tracking "the next time something needs to happen" for a large number of items
+without having to scan all of them:
+
+	h := timerheap.New()
+	h.Schedule("db1/backup", time.Now().Add(time.Minute))
+	...
+	for _, key := range h.PopDue(time.Now()) {
+		// handle key
+	}
+
+Schedule, Remove and popping a key are all O(log n). Heaps are not safe to be
+called from multiple goroutines.
+
+*/
+package timerheap
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Heap is a min-heap of deadlines keyed by string
+type Heap struct {
+	timers timers
+	byKey  map[string]*timer
+}
+
+type timer struct {
+	key   string
+	at    time.Time
+	index int
+}
+
+// timers implements heap.Interface
+type timers []*timer
+
+func (t timers) Len() int           { return len(t) }
+func (t timers) Less(i, j int) bool { return t[i].at.Before(t[j].at) }
+func (t timers) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+	t[i].index = i
+	t[j].index = j
+}
+
+func (t *timers) Push(x interface{}) {
+	tm := x.(*timer)
+	tm.index = len(*t)
+	*t = append(*t, tm)
+}
+
+func (t *timers) Pop() interface{} {
+	old := *t
+	n := len(old)
+	tm := old[n-1]
+	old[n-1] = nil
+	*t = old[:n-1]
+	return tm
+}
+
+// New returns an empty heap
+func New() *Heap {
+	return &Heap{byKey: make(map[string]*timer)}
+}
+
+// Schedule sets the deadline for key, replacing any deadline it already had
+func (h *Heap) Schedule(key string, at time.Time) {
+	if tm, ok := h.byKey[key]; ok {
+		tm.at = at
+		heap.Fix(&h.timers, tm.index)
+		return
+	}
+	tm := &timer{key: key, at: at}
+	h.byKey[key] = tm
+	heap.Push(&h.timers, tm)
+}
+
+// Remove clears the deadline for key (if it has one)
+func (h *Heap) Remove(key string) {
+	if tm, ok := h.byKey[key]; ok {
+		heap.Remove(&h.timers, tm.index)
+		delete(h.byKey, key)
+	}
+}
+
+// Next returns the earliest deadline. ok is false if the heap is empty.
+func (h *Heap) Next() (key string, at time.Time, ok bool) {
+	if len(h.timers) == 0 {
+		return "", time.Time{}, false
+	}
+	return h.timers[0].key, h.timers[0].at, true
+}
+
+// PopDue removes and returns the keys of all deadlines at or before now, earliest first
+func (h *Heap) PopDue(now time.Time) []string {
+	var due []string
+	for len(h.timers) > 0 && !h.timers[0].at.After(now) {
+		tm := heap.Pop(&h.timers).(*timer)
+		delete(h.byKey, tm.key)
+		due = append(due, tm.key)
+	}
+	return due
+}
+
+// Len returns the number of keys with a deadline
+func (h *Heap) Len() int {
+	return len(h.timers)
+}
@@ -0,0 +1,93 @@
+package timerheap
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPopDueInDeadlineOrder(t *testing.T) {
+	now := time.Unix(1000, 0)
+	h := New()
+	h.Schedule("c", now.Add(3*time.Second))
+	h.Schedule("a", now.Add(1*time.Second))
+	h.Schedule("b", now.Add(2*time.Second))
+	h.Schedule("later", now.Add(time.Hour))
+
+	due := h.PopDue(now.Add(3 * time.Second))
+	if fmt.Sprint(due) != "[a b c]" {
+		t.Errorf("Expected [a b c] to be due, got %v", due)
+	}
+	if h.Len() != 1 {
+		t.Errorf("Expected 1 deadline left, found %d", h.Len())
+	}
+}
+
+func TestScheduleMovesExistingDeadline(t *testing.T) {
+	now := time.Unix(1000, 0)
+	h := New()
+	h.Schedule("a", now.Add(time.Second))
+	h.Schedule("b", now.Add(2*time.Second))
+	h.Schedule("a", now.Add(time.Hour))
+
+	if h.Len() != 2 {
+		t.Errorf("Scheduling an existing key should not add a deadline, found %d", h.Len())
+	}
+	if key, _, _ := h.Next(); key != "b" {
+		t.Errorf("Expected 'b' to be next after moving 'a', got '%s'", key)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	now := time.Unix(1000, 0)
+	h := New()
+	h.Schedule("a", now)
+	h.Schedule("b", now)
+	h.Remove("a")
+	h.Remove("not-there")
+
+	due := h.PopDue(now)
+	if fmt.Sprint(due) != "[b]" {
+		t.Errorf("Expected only [b] to be due, got %v", due)
+	}
+	if _, _, ok := h.Next(); ok {
+		t.Errorf("Expected heap to be empty")
+	}
+}
+
+func newFullHeap(n int, now time.Time) *Heap {
+	h := New()
+	for i := 0; i < n; i++ {
+		h.Schedule(fmt.Sprintf("host-%d/service", i), now.Add(time.Duration(i)*time.Millisecond))
+	}
+	return h
+}
+
+func BenchmarkSchedule100k(b *testing.B) {
+	now := time.Unix(1000, 0)
+	h := newFullHeap(100000, now)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.Schedule(fmt.Sprintf("host-%d/service", i%100000), now.Add(time.Duration(i%7200)*time.Second))
+	}
+}
+
+func BenchmarkPopNothingDue100k(b *testing.B) {
+	now := time.Unix(1000, 0)
+	h := newFullHeap(100000, now.Add(time.Hour))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.PopDue(now)
+	}
+}
+
+func BenchmarkPopAndReschedule100k(b *testing.B) {
+	now := time.Unix(1000, 0)
+	h := newFullHeap(100000, now)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key, at, _ := h.Next()
+		h.PopDue(at)
+		h.Schedule(key, at.Add(time.Hour))
+	}
+}
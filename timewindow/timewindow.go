@@ -39,7 +39,8 @@ func New(epoch0 int64, size int) *Window {
 		counts:  make([]int, size),
 		epoch:   epoch0,
 		headIdx: 0,
-		tailIdx: 1,
+		// with a single epoch of history the head and the tail are the same
+		tailIdx: 1 % size,
 	}
 
 	return w
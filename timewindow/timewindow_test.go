@@ -36,3 +36,12 @@ func TestWindow(t *testing.T) {
 		}
 	}
 }
+
+func TestWindowOfOneEpoch(t *testing.T) {
+	w := New(100, 1)
+	w.Add(100, 2)
+	w.Add(101, 1)
+	if total := w.Total(); total != 1 {
+		t.Errorf("total=%d wanted 1\n", total)
+	}
+}
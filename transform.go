@@ -0,0 +1,124 @@
+package main
+
+/**
+ * File: transform.go
+ *
+ * Check results are transformed after they are parsed and before they reach the gateway, so
+ * that everything after (buffering, deduplication, the audit log, ...) works on what the result
+ * should have said. The output is rewritten first (see rewrite.go) and parsed into its text and
+ * perfdata (see the perfdata package), then the state is remapped and finally recomputed from
+ * the policy's perfdata thresholds (see threshold.go).
+ *
+ * Some plugins misuse their exit codes: they return UNKNOWN when they mean CRITICAL, or WARNING
+ * when they mean OK. Policies can remap the state of their results with 'state_map' rules, each
+ * matching on the state, on a regular expression over the output, or both. The first rule that
+ * matches a result remaps it. The original state is kept on the message for the audit log, and
+ * can be shown in the output sent upstream.
+ */
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/JohnMurray/nbad/perfdata"
+)
+
+// StateRule remaps the state of the results it matches
+type StateRule struct {
+	// State - name of the state the rule applies to (any state if empty)
+	State string `json:"state"`
+
+	// OutputRegex - regular expression the output has to contain a match for (any output if empty)
+	OutputRegex string `json:"output_regex"`
+
+	// To - name of the state matching results are remapped to
+	To string `json:"to"`
+
+	state       uint16
+	anyState    bool
+	outputRegex *regexp.Regexp
+	to          uint16
+}
+
+// String describes the rule, for log and error messages
+func (r *StateRule) String() string {
+	return fmt.Sprintf("state rule '%s' /%s/ to '%s'", r.State, r.OutputRegex, r.To)
+}
+
+func (r *StateRule) compile() error {
+	if r.State == "" && r.OutputRegex == "" {
+		return fmt.Errorf("%s: needs a state or an output_regex", r)
+	}
+	var ok bool
+	if r.anyState = r.State == ""; !r.anyState {
+		if r.state, ok = stateByName(r.State); !ok {
+			return fmt.Errorf("%s: unknown state '%s'", r, r.State)
+		}
+	}
+	if r.to, ok = stateByName(r.To); !ok {
+		return fmt.Errorf("%s: unknown state '%s'", r, r.To)
+	}
+	if r.OutputRegex != "" {
+		re, err := regexp.Compile(r.OutputRegex)
+		if err != nil {
+			return fmt.Errorf("%s: invalid output_regex: %v", r, err)
+		}
+		r.outputRegex = re
+	}
+	return nil
+}
+
+// matches returns true if the rule applies to the message
+func (r *StateRule) matches(m *Message) bool {
+	if !r.anyState && m.State != r.state {
+		return false
+	}
+	return r.outputRegex == nil || r.outputRegex.MatchString(m.Message)
+}
+
+// transform - applies the policy of the message (at the time it was received) to it, and
+// attaches its parsed output
+func transform(m *Message, now time.Time) {
+	p := Config().policyFor(m.Host, m.Service, now)
+	if p != nil {
+		rewriteOutput(m, p)
+	}
+	parseOutput(m)
+	if p == nil {
+		return
+	}
+	remapState(m, p)
+	applyThresholds(m, p)
+	if m.Remapped && p.ShowOriginalState {
+		note := "reported as " + stateName(m.OriginalState)
+		m.Message = addNote(m.Message, note)
+		m.Parsed.Text = addNote(m.Parsed.Text, note)
+	}
+}
+
+// parseOutput - attaches the output split into its text and perfdata to the message, in the
+// configured perfdata parsing mode
+func parseOutput(m *Message) {
+	parsed, err := perfdata.Parse(m.Message, Config().perfdataMode)
+	if err != nil {
+		Logger().Warning.Printf("ignoring perfdata of service '%s' on host '%s': %v\n", m.Service, m.Host, err)
+	}
+	m.Parsed = parsed
+}
+
+// remapState - applies the first state rule of the policy that matches the message
+func remapState(m *Message, p *Policy) {
+	for _, r := range p.StateMap {
+		if !r.matches(m) {
+			continue
+		}
+		if r.to != m.State {
+			Logger().Trace.Printf("remapping state '%s' of service '%s' to '%s'\n",
+				stateName(m.State), m.Service, stateName(r.to))
+			m.OriginalState, m.Remapped = m.State, true
+			m.State = r.to
+		}
+		return
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRemapState(t *testing.T) {
+	useTestConfig(t, &NbadConfig{Policies: []*Policy{{Service: "vendor-*", ShowOriginalState: true,
+		StateMap: []*StateRule{
+			{State: "unknown", OutputRegex: "timed out", To: "critical"},
+			{State: "WARNING", To: "OK"},
+		}}}})
+
+	var tests = []struct {
+		service  string
+		state    uint16
+		output   string
+		expected uint16
+		remapped bool
+	}{
+		{"vendor-raid", stateUnknown, "controller timed out", stateCritical, true},
+		{"vendor-raid", stateUnknown, "no such device", stateUnknown, false},
+		{"vendor-raid", stateWarning, "battery learning cycle", stateOk, true},
+		{"vendor-raid", stateCritical, "disk failed", stateCritical, false},
+		{"raid", stateWarning, "battery learning cycle", stateWarning, false},
+	}
+	for i, tt := range tests {
+		m := &Message{Host: "h", Service: tt.service, State: tt.state, Message: tt.output}
+		transform(m, time.Unix(1000, 0))
+		if m.State != tt.expected || m.Remapped != tt.remapped {
+			t.Errorf("failed test %d: state=%s remapped=%v, wanted %s remapped=%v", i,
+				stateName(m.State), m.Remapped, stateName(tt.expected), tt.remapped)
+		}
+		if tt.remapped && (m.OriginalState != tt.state || m.Message != tt.output+" [nbad: reported as "+stateName(tt.state)+"]") {
+			t.Errorf("failed test %d: expected the original state to be kept and shown, got %s", i, m.Message)
+		}
+	}
+}
+
+func TestRemappedStateIsAudited(t *testing.T) {
+	useTestConfig(t, &NbadConfig{})
+	m := &Message{Host: "h", Service: "s", State: stateCritical, OriginalState: stateUnknown, Remapped: true}
+	r := newAuditRecord(time.Unix(1000, 0), ruleBuffered, &MessageEntry{host: "h", service: "s"}, m, nil, nil)
+	if r.OriginalState != "UNKNOWN" || r.NewState != "CRITICAL" {
+		t.Errorf("Expected the audit record to have both states, got %s and %s", r.OriginalState, r.NewState)
+	}
+}
+
+func TestStateRuleNeedsAMatch(t *testing.T) {
+	c := &NbadConfig{Policies: []*Policy{{Service: "s", StateMap: []*StateRule{{To: "OK"}}}}}
+	if err := c.compile(); err == nil {
+		t.Errorf("Expected a state rule matching everything to be rejected")
+	}
+}
+
+func TestParsedOutputIsAttached(t *testing.T) {
+	useTestConfig(t, &NbadConfig{Policies: []*Policy{{Service: "disk", ShowOriginalState: true,
+		StateMap: []*StateRule{{State: "WARNING", To: "OK"}}}}})
+
+	m := &Message{Host: "h", Service: "disk", State: stateWarning, Message: "DISK WARNING - 81% used | /=81%;80;90"}
+	transform(m, time.Unix(1000, 0))
+	if m.Message != "DISK WARNING - 81% used [nbad: reported as WARNING] | /=81%;80;90" {
+		t.Errorf("Expected the note to go before the perfdata, got '%s'", m.Message)
+	}
+	if m.Parsed == nil || m.Parsed.Text != "DISK WARNING - 81% used [nbad: reported as WARNING]" ||
+		len(m.Parsed.Perfdata) != 1 || m.Parsed.Perfdata[0].Value != 81 || m.Parsed.Perfdata[0].Crit != "90" {
+		t.Errorf("Expected the parsed output to be attached, got %+v", m.Parsed)
+	}
+}
+
+func TestStrictPerfdataParsing(t *testing.T) {
+	useTestConfig(t, &NbadConfig{PerfdataParsing: "strict"})
+	m := &Message{Host: "h", Service: "s", Message: "OK | a=1 junk"}
+	transform(m, time.Unix(1000, 0))
+	if m.Parsed == nil || m.Parsed.Text != "OK" || m.Parsed.Perfdata != nil {
+		t.Errorf("Expected invalid perfdata to be ignored in strict mode, got %+v", m.Parsed)
+	}
+
+	c := &NbadConfig{PerfdataParsing: "picky"}
+	if err := c.compile(); err == nil {
+		t.Errorf("Expected an unknown perfdata parsing mode to be rejected")
+	}
+}
+
+func TestPerfdataThresholds(t *testing.T) {
+	useTestConfig(t, &NbadConfig{Policies: []*Policy{
+		{Service: "disk", ShowOriginalState: true, Thresholds: []*Threshold{
+			{LabelRegex: "/var(/.*)?", Warning: "90", Critical: "95"},
+			{Warning: "80", Critical: "90"},
+		}},
+		{Service: "vendor", StateMap: []*StateRule{{State: "UNKNOWN", To: "CRITICAL"}},
+			Thresholds: []*Threshold{{Label: "temp", Critical: "@~:0"}}},
+	}})
+
+	var tests = []struct {
+		service  string
+		state    uint16
+		output   string
+		expected uint16
+	}{
+		// client-side thresholds were too strict
+		{"disk", stateCritical, "DISK CRITICAL | /var/log=91%;70;80", stateWarning},
+		{"disk", stateWarning, "DISK WARNING | /var/log=85% /=79%", stateOk},
+		// the worst value wins
+		{"disk", stateOk, "DISK OK | /var=50% /home=93%", stateCritical},
+		// no matching or known values
+		{"disk", stateWarning, "DISK WARNING | inodes=90%", stateWarning},
+		{"disk", stateUnknown, "DISK UNKNOWN | /=U", stateUnknown},
+		// thresholds apply after the state map
+		{"vendor", stateUnknown, "TEMP | temp=-3", stateCritical},
+		{"vendor", stateUnknown, "TEMP | temp=20", stateOk},
+		{"vendor", stateUnknown, "no reading", stateCritical},
+	}
+	for i, tt := range tests {
+		m := &Message{Host: "h", Service: tt.service, State: tt.state, Message: tt.output}
+		transform(m, time.Unix(1000, 0))
+		if m.State != tt.expected {
+			t.Errorf("failed test %d: state=%s, wanted %s", i, stateName(m.State), stateName(tt.expected))
+		}
+		if m.Remapped != (tt.state != tt.expected) || (m.Remapped && m.OriginalState != tt.state) {
+			t.Errorf("failed test %d: expected the original state to be kept, got remapped=%v original=%s",
+				i, m.Remapped, stateName(m.OriginalState))
+		}
+	}
+
+	m := &Message{Host: "h", Service: "disk", State: stateOk, Message: "DISK OK | /=85%"}
+	transform(m, time.Unix(1000, 0))
+	if m.Message != "DISK OK [nbad: reported as OK] | /=85%" {
+		t.Errorf("Expected the original state to be shown, got '%s'", m.Message)
+	}
+}
+
+func TestThresholdNeedsARange(t *testing.T) {
+	for _, th := range []*Threshold{{Label: "a"}, {Label: "a", Warning: "20:10"},
+		{Label: "a", LabelRegex: "a", Warning: "10"}, {LabelRegex: "(", Warning: "10"}} {
+		c := &NbadConfig{Policies: []*Policy{{Service: "s", Thresholds: []*Threshold{th}}}}
+		if err := c.compile(); err == nil {
+			t.Errorf("Expected %s to be rejected", th)
+		}
+	}
+}
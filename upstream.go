@@ -0,0 +1,76 @@
+package main
+
+/**
+ * File: upstream.go
+ *
+ * Everything the gateway decides to tell the master Nagios host goes through an Upstream.
+ * Actually pushing results upstream is not implemented yet, so the default Upstream simply
+ * logs what would have been sent.
+ */
+
+import "strings"
+
+// synthesizedPrefix is prepended to the output of any result nbad made up on its own so that
+// whoever reads it in Nagios knows the state did not come from the check itself
+const synthesizedPrefix = "[nbad] "
+
+// nbadHost is the default host of the results nbad sends that belong to no single client host
+// (storm digests, rollups)
+const nbadHost = "nbad"
+
+// Notification is a check result the gateway has decided to send upstream
+type Notification struct {
+	// Message is the check result to send
+	Message *Message
+	// Reason is a short explanation of why the result is being sent
+	Reason string
+	// Synthesized is set when nbad generated the state rather than a client reporting it
+	Synthesized bool
+	// Route is the name of the upstream route to send the result through ("" for the default)
+	Route string
+}
+
+// Upstream is anything that can receive notifications from the gateway
+type Upstream interface {
+	Send(n *Notification) error
+}
+
+// logUpstream is the default Upstream, it only logs the notifications
+type logUpstream struct{}
+
+func (logUpstream) Send(n *Notification) error {
+	route := n.Route
+	if route == "" {
+		route = "default"
+	}
+	Logger().Info.Printf("PUSH sending state '%s' for service '%s' upstream via %s route (%s)",
+		stateName(n.Message.State), n.Message.Service, route, n.Reason)
+	return nil
+}
+
+// addNote adds a note from nbad to the first line of text of the output, ahead of its perfdata
+func addNote(output string, note string) string {
+	line, rest := output, ""
+	if i := strings.Index(output, "\n"); i >= 0 {
+		line, rest = output[:i], output[i:]
+	}
+	note = " [nbad: " + note + "]"
+	if i := strings.Index(line, "|"); i >= 0 {
+		return strings.TrimRight(line[:i], " ") + note + " " + line[i:] + rest
+	}
+	return line + note + rest
+}
+
+// newSynthesizedMessage builds a message for a state nbad generated on behalf of the client
+func newSynthesizedMessage(from *Message, state uint16, output string, timestamp uint32) *Message {
+	if !strings.HasPrefix(output, synthesizedPrefix) {
+		output = synthesizedPrefix + output
+	}
+	return &Message{
+		Timestamp: timestamp,
+		State:     state,
+		Host:      from.Host,
+		Service:   from.Service,
+		Message:   output,
+	}
+}